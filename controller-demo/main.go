@@ -1,21 +1,59 @@
 package main
 
 import (
+	"flag"
+	"strings"
 	"time"
 
 	"controller-demo/pkg"
 	"controller-demo/pkg/signals"
 
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
 const workerNum = 5
 
 func main() {
+	var output, namespaces, excludeNamespaces, selector, ingressClass string
+	var defaultsName, defaultsNamespace string
+	var webhookAddr, webhookCertDir string
+	flag.StringVar(&output, "output", pkg.OutputIngress, "kind of resource generated for annotated services, ingress or httproute")
+	flag.StringVar(&namespaces, "namespaces", "", "comma separated namespaces to watch, empty means all namespaces")
+	flag.StringVar(&excludeNamespaces, "exclude-namespaces", "", "comma separated namespaces to ignore")
+	flag.StringVar(&selector, "selector", "", "label selector restricting the watched services")
+	flag.StringVar(&ingressClass, "ingress-class", "", "only handle services whose ingress/class annotation matches, and stamp it on generated resources")
+	flag.StringVar(&defaultsName, "defaults-configmap", "", "name of the configmap holding host template, ingress class, tls secret and annotation defaults")
+	flag.StringVar(&defaultsNamespace, "defaults-configmap-namespace", "kube-system", "namespace of the defaults configmap")
+	flag.StringVar(&webhookAddr, "webhook-addr", "", "address of the validating webhook server, empty disables the webhook")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs", "directory holding tls.crt and tls.key for the webhook server")
+	flag.Parse()
+
+	if output != pkg.OutputIngress && output != pkg.OutputHTTPRoute {
+		klog.Fatalf("invalid --output %q, must be %s or %s", output, pkg.OutputIngress, pkg.OutputHTTPRoute)
+	}
+	if _, err := labels.Parse(selector); err != nil {
+		klog.Fatalf("invalid --selector %q: %s", selector, err.Error())
+	}
+
+	scope := pkg.Scope{
+		Namespaces:        splitList(namespaces),
+		ExcludeNamespaces: splitList(excludeNamespaces),
+		IngressClass:      ingressClass,
+	}
+
 	stopChan := signals.SetupSignalHandler()
 
 	config, err := clientcmd.BuildConfigFromFlags("", clientcmd.RecommendedHomeFile)
@@ -31,16 +69,105 @@ func main() {
 		klog.Fatalf("failed to build kubernetes client: %s", err.Error())
 	}
 
-	factory := informers.NewSharedInformerFactory(clientSet, time.Second*30)
+	// a single allowed namespace can be watched directly, otherwise the controller filters
+	var namespace string
+	if len(scope.Namespaces) == 1 {
+		namespace = scope.Namespaces[0]
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(clientSet, time.Second*30, informers.WithNamespace(namespace))
+	// the label selector only applies to services, generated resources are never labelled
+	serviceFactory := informers.NewSharedInformerFactoryWithOptions(clientSet, time.Second*30,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *v1.ListOptions) {
+			options.LabelSelector = selector
+		}))
+
+	serviceInformer := serviceFactory.Core().V1().Services()
+
+	var controller pkg.Controller
+	var dynamicClient dynamic.Interface
+	var dynamicFactory dynamicinformer.DynamicSharedInformerFactory
+	if output == pkg.OutputHTTPRoute {
+		dynamicClient, err = dynamic.NewForConfig(config)
+		if err != nil {
+			klog.Fatalf("failed to build dynamic client: %s", err.Error())
+		}
+
+		dynamicFactory = dynamicinformer.NewFilteredDynamicSharedInformerFactory(dynamicClient, time.Second*30, namespace, nil)
+		routeInformer := dynamicFactory.ForResource(pkg.HTTPRouteResource)
+
+		controller = pkg.NewHTTPRouteController(clientSet, dynamicClient, serviceInformer, routeInformer)
+	} else {
+		ingressInformer := factory.Networking().V1().Ingresses()
+
+		controller = pkg.NewController(clientSet, serviceInformer, ingressInformer)
+	}
 
-	serviceInformer := factory.Core().V1().Services()
-	ingressInformer := factory.Networking().V1().Ingresses()
+	controller.SetScope(scope)
 
-	controller := pkg.NewController(clientSet, serviceInformer, ingressInformer)
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartStructuredLogging(0)
+	eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientSet.CoreV1().Events("")})
+	controller.SetRecorder(eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "ingress-manager"}))
+
+	if defaultsName != "" {
+		configMapFactory := informers.NewSharedInformerFactoryWithOptions(clientSet, time.Second*30,
+			informers.WithNamespace(defaultsNamespace),
+			informers.WithTweakListOptions(func(options *v1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", defaultsName).String()
+			}))
+		controller.WatchDefaults(configMapFactory.Core().V1().ConfigMaps(), defaultsNamespace, defaultsName)
+		configMapFactory.Start(stopChan)
+	}
+
+	if webhookAddr != "" {
+		// hosts are unique across the cluster, so the webhook looks for conflicts in every namespace,
+		// also when --namespaces restricts the controller to a single one
+		webhookFactory, webhookDynamicFactory := factory, dynamicFactory
+		if namespace != "" {
+			webhookFactory = informers.NewSharedInformerFactory(clientSet, time.Second*30)
+			if dynamicClient != nil {
+				webhookDynamicFactory = dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, time.Second*30)
+			}
+		}
+		var routeInformer informers.GenericInformer
+		if webhookDynamicFactory != nil {
+			routeInformer = webhookDynamicFactory.ForResource(pkg.HTTPRouteResource)
+		}
+
+		webhook, err := pkg.NewWebhook(&controller, webhookFactory.Networking().V1().Ingresses(), routeInformer)
+		if err != nil {
+			klog.Fatalf("failed to build webhook: %s", err.Error())
+		}
+		webhookFactory.Start(stopChan)
+		if webhookDynamicFactory != nil {
+			webhookDynamicFactory.Start(stopChan)
+		}
+		go func() {
+			if err := webhook.Run(webhookAddr, webhookCertDir, stopChan); err != nil {
+				klog.Fatalf("failed to run webhook: %s", err.Error())
+			}
+		}()
+	}
 
 	factory.Start(stopChan)
+	serviceFactory.Start(stopChan)
+	if dynamicFactory != nil {
+		dynamicFactory.Start(stopChan)
+	}
 
 	if err := controller.Run(workerNum, stopChan); err != nil {
 		klog.Fatalf("failed to run controller: %s", err.Error())
 	}
 }
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
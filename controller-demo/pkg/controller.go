@@ -4,33 +4,67 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
 	v17 "k8s.io/api/core/v1"
 	v15 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	v16 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
 	v13 "k8s.io/client-go/informers/core/v1"
 	v14 "k8s.io/client-go/informers/networking/v1"
 	"k8s.io/client-go/kubernetes"
 	v1 "k8s.io/client-go/listers/core/v1"
 	v12 "k8s.io/client-go/listers/networking/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 )
 
 const maxRetry = 10
 
+// annotations overriding the generated host and backend port
+const (
+	hostAnnotation = "ingress/host"
+	// portAnnotation is a port number or port name from the Service spec
+	portAnnotation = "ingress/port"
+)
+
+const defaultPort = 80
+
+const (
+	// OutputIngress generates a networking.k8s.io/v1 Ingress for each annotated Service.
+	OutputIngress = "ingress"
+	// OutputHTTPRoute generates a gateway.networking.k8s.io/v1 HTTPRoute for each annotated Service.
+	OutputHTTPRoute = "httproute"
+)
+
 type Controller struct {
 	client        kubernetes.Interface
+	dynamicClient dynamic.Interface
+	output        string
+	scope         Scope
 	serviceLister v1.ServiceLister
 	serviceSynced cache.InformerSynced
 	ingressLister v12.IngressLister
 	ingressSynced cache.InformerSynced
+	routeLister   cache.GenericLister
+	routeSynced   cache.InformerSynced
 	queue         workqueue.RateLimitingInterface
+	recorder      record.EventRecorder
+
+	configMapLister    v1.ConfigMapLister
+	configMapSynced    cache.InformerSynced
+	configMapNamespace string
+	configMapName      string
 }
 
 func (c *Controller) Run(workerNum int, stopChan <-chan struct{}) error {
@@ -40,7 +74,16 @@ func (c *Controller) Run(workerNum int, stopChan <-chan struct{}) error {
 	klog.Info("starting controller")
 
 	klog.Info("waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopChan, c.serviceSynced, c.ingressSynced); !ok {
+	synced := []cache.InformerSynced{c.serviceSynced}
+	if c.output == OutputHTTPRoute {
+		synced = append(synced, c.routeSynced)
+	} else {
+		synced = append(synced, c.ingressSynced)
+	}
+	if c.configMapSynced != nil {
+		synced = append(synced, c.configMapSynced)
+	}
+	if ok := cache.WaitForCacheSync(stopChan, synced...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
@@ -68,7 +111,14 @@ func (c *Controller) updateService(oldObj interface{}, newObj interface{}) {
 }
 
 func (c *Controller) deleteIngress(obj interface{}) {
-	ingress := obj.(*v15.Ingress)
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	ingress, ok := obj.(*v15.Ingress)
+	if !ok {
+		runtime.HandleError(fmt.Errorf("expected an ingress, got %T", obj))
+		return
+	}
 	// get OwnerReference
 	ownerReference := v16.GetControllerOf(ingress)
 
@@ -77,7 +127,7 @@ func (c *Controller) deleteIngress(obj interface{}) {
 	}
 
 	// c.queue.Add(ingress.Namespace + "/" + ingress.Name)
-	c.enqueue(obj)
+	c.enqueue(ingress)
 }
 
 func (c *Controller) enqueue(obj interface{}) {
@@ -132,6 +182,10 @@ func (c *Controller) syncService(key string) error {
 		return nil
 	}
 
+	if !c.scope.InNamespace(namespace) {
+		return nil
+	}
+
 	service, err := c.serviceLister.Services(namespace).Get(name)
 	if errors.IsNotFound(err) {
 		return nil
@@ -142,6 +196,19 @@ func (c *Controller) syncService(key string) error {
 
 	// annotations map[string][string]
 	v := service.GetAnnotations()["ingress/http"]
+	if !c.scope.Requests(service) {
+		// the service belongs to another instance, only clean up what this one created
+		v = ""
+	}
+
+	if c.output == OutputHTTPRoute {
+		return c.syncHTTPRoute(service, v)
+	}
+
+	defaults, err := c.defaults()
+	if err != nil {
+		return err
+	}
 
 	ingress, err := c.ingressLister.Ingresses(namespace).Get(name)
 	if err != nil && !errors.IsNotFound(err) {
@@ -150,14 +217,41 @@ func (c *Controller) syncService(key string) error {
 
 	if v == "true" && errors.IsNotFound(err) {
 		// 	create ingress
-		ingressObj := c.constructIngress(service)
+		ingressObj, err := c.constructIngress(service, defaults)
+		if err != nil {
+			return err
+		}
 		klog.Infof("creating ingress %s in %s", name, namespace)
-		_, err := c.client.NetworkingV1().Ingresses(namespace).Create(context.TODO(), ingressObj, v16.CreateOptions{})
+		_, err = c.client.NetworkingV1().Ingresses(namespace).Create(context.TODO(), ingressObj, v16.CreateOptions{})
 		if err != nil {
 			klog.Errorf("failed to create ingress %s in %s", name, namespace)
 			return err
 		}
-	} else if v != "true" && ingress != nil {
+	} else if v == "true" && ingress != nil && c.ownsIngress(ingress, service) {
+		// update ingress when the defaults changed
+		ingressObj, err := c.constructIngress(service, defaults)
+		if err != nil {
+			return err
+		}
+		if equality.Semantic.DeepEqual(ingress.Spec, ingressObj.Spec) && hasAnnotations(ingress, ingressObj.Annotations) {
+			return nil
+		}
+		ingressCopy := ingress.DeepCopy()
+		ingressCopy.Spec = ingressObj.Spec
+		// annotations added by other tools are kept
+		if ingressCopy.Annotations == nil {
+			ingressCopy.Annotations = map[string]string{}
+		}
+		for k, v := range ingressObj.Annotations {
+			ingressCopy.Annotations[k] = v
+		}
+		klog.Infof("updating ingress %s in %s", name, namespace)
+		_, err = c.client.NetworkingV1().Ingresses(namespace).Update(context.TODO(), ingressCopy, v16.UpdateOptions{})
+		if err != nil {
+			klog.Errorf("failed to update ingress %s in %s", name, namespace)
+			return err
+		}
+	} else if v != "true" && ingress != nil && c.ownsIngress(ingress, service) {
 		// delete ingress
 		klog.Infof("deleting ingress %s in %s", name, namespace)
 		err := c.client.NetworkingV1().Ingresses(namespace).Delete(context.TODO(), name, v16.DeleteOptions{})
@@ -169,12 +263,55 @@ func (c *Controller) syncService(key string) error {
 	return nil
 }
 
-func (c *Controller) constructIngress(service *v17.Service) *v15.Ingress {
+// ingressClassName is the class stamped on generated resources, the scope class wins over the defaults.
+func (c *Controller) ingressClassName(defaults *Defaults) string {
+	if c.scope.IngressClass != "" {
+		return c.scope.IngressClass
+	}
+	return defaults.IngressClassName
+}
+
+// ownsIngress reports whether ingress was created by this instance for service. Like HTTPRoutes,
+// generated Ingresses carry the class of the instance in the ingress/class annotation, so that
+// ownership does not depend on the ingressClassName, which follows the defaults ConfigMap.
+func (c *Controller) ownsIngress(ingress *v15.Ingress, service *v17.Service) bool {
+	return v16.IsControlledBy(ingress, service) && ingress.GetAnnotations()[classAnnotation] == c.scope.IngressClass
+}
+
+// hasAnnotations reports whether ingress carries every annotation of annotations.
+func hasAnnotations(ingress *v15.Ingress, annotations map[string]string) bool {
+	for k, v := range annotations {
+		if value, ok := ingress.Annotations[k]; !ok || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Controller) constructIngress(service *v17.Service, defaults *Defaults) (*v15.Ingress, error) {
+	host, err := defaults.Host(service)
+	if err != nil {
+		return nil, err
+	}
+	port, err := backendPort(service)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := map[string]string{}
+	for k, v := range defaults.Annotations {
+		annotations[k] = v
+	}
+	if c.scope.IngressClass != "" {
+		annotations[classAnnotation] = c.scope.IngressClass
+	}
+
 	pathType := v15.PathTypePrefix
 	ingress := v15.Ingress{
 		ObjectMeta: v16.ObjectMeta{
-			Name:      service.Name,
-			Namespace: service.Namespace,
+			Name:        service.Name,
+			Namespace:   service.Namespace,
+			Annotations: annotations,
 			OwnerReferences: []v16.OwnerReference{
 				*v16.NewControllerRef(service, v17.SchemeGroupVersion.WithKind("Service")),
 			},
@@ -182,7 +319,7 @@ func (c *Controller) constructIngress(service *v17.Service) *v15.Ingress {
 		Spec: v15.IngressSpec{
 			Rules: []v15.IngressRule{
 				{
-					Host: "example.com",
+					Host: host,
 					IngressRuleValue: v15.IngressRuleValue{
 						HTTP: &v15.HTTPIngressRuleValue{
 							Paths: []v15.HTTPIngressPath{
@@ -192,9 +329,7 @@ func (c *Controller) constructIngress(service *v17.Service) *v15.Ingress {
 									Backend: v15.IngressBackend{
 										Service: &v15.IngressServiceBackend{
 											Name: service.Name,
-											Port: v15.ServiceBackendPort{
-												Number: 80,
-											},
+											Port: port,
 										},
 									},
 								},
@@ -205,13 +340,57 @@ func (c *Controller) constructIngress(service *v17.Service) *v15.Ingress {
 			},
 		},
 	}
-	return &ingress
+	if ingressClassName := c.ingressClassName(defaults); ingressClassName != "" {
+		ingress.Spec.IngressClassName = &ingressClassName
+	}
+	if defaults.TLSSecret != "" {
+		ingress.Spec.TLS = []v15.IngressTLS{
+			{
+				Hosts:      []string{host},
+				SecretName: defaults.TLSSecret,
+			},
+		}
+	}
+	return &ingress, nil
+}
+
+// backendPort returns the Service port named by the ingress/port annotation, 80 by default.
+func backendPort(service *v17.Service) (v15.ServiceBackendPort, error) {
+	v := service.GetAnnotations()[portAnnotation]
+	if v == "" {
+		return v15.ServiceBackendPort{Number: defaultPort}, nil
+	}
+	if number, err := strconv.ParseInt(v, 10, 32); err == nil {
+		return v15.ServiceBackendPort{Number: int32(number)}, nil
+	}
+	if errs := validation.IsValidPortName(v); len(errs) > 0 {
+		return v15.ServiceBackendPort{}, fmt.Errorf("invalid %s annotation %q: %s", portAnnotation, v, strings.Join(errs, ", "))
+	}
+	return v15.ServiceBackendPort{Name: v}, nil
+}
+
+// SetScope restricts the controller to the Services selected by scope.
+func (c *Controller) SetScope(scope Scope) {
+	c.scope = scope
+}
+
+// SetRecorder makes the controller report on Services through Kubernetes events.
+func (c *Controller) SetRecorder(recorder record.EventRecorder) {
+	c.recorder = recorder
+}
+
+// event records an event on service when a recorder is set.
+func (c *Controller) event(service *v17.Service, eventType, reason, message string) {
+	if c.recorder != nil {
+		c.recorder.Event(service, eventType, reason, message)
+	}
 }
 
 func NewController(client kubernetes.Interface, serviceInformer v13.ServiceInformer, ingressInformer v14.IngressInformer) Controller {
 
 	c := Controller{
 		client:        client,
+		output:        OutputIngress,
 		serviceLister: serviceInformer.Lister(),
 		serviceSynced: serviceInformer.Informer().HasSynced,
 		ingressLister: ingressInformer.Lister(),
@@ -230,3 +409,30 @@ func NewController(client kubernetes.Interface, serviceInformer v13.ServiceInfor
 
 	return c
 }
+
+// NewHTTPRouteController builds a controller that manages HTTPRoutes instead of Ingresses.
+// HTTPRoutes are read and written through the dynamic client, so no generated Gateway API clients are needed.
+func NewHTTPRouteController(client kubernetes.Interface, dynamicClient dynamic.Interface, serviceInformer v13.ServiceInformer, routeInformer informers.GenericInformer) Controller {
+
+	c := Controller{
+		client:        client,
+		dynamicClient: dynamicClient,
+		output:        OutputHTTPRoute,
+		serviceLister: serviceInformer.Lister(),
+		serviceSynced: serviceInformer.Informer().HasSynced,
+		routeLister:   routeInformer.Lister(),
+		routeSynced:   routeInformer.Informer().HasSynced,
+		queue:         workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "httproute-manager"),
+	}
+
+	serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.addService,
+		UpdateFunc: c.updateService,
+	})
+
+	routeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: c.deleteHTTPRoute,
+	})
+
+	return c
+}
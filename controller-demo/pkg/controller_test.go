@@ -0,0 +1,347 @@
+package pkg
+
+import (
+	"fmt"
+	"testing"
+
+	v17 "k8s.io/api/core/v1"
+	v15 "k8s.io/api/networking/v1"
+	v16 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+type fixture struct {
+	t *testing.T
+
+	client *fake.Clientset
+
+	// objects to put in the informer indexers
+	serviceLister []*v17.Service
+	ingressLister []*v15.Ingress
+	// objects to put in the fake clientset tracker
+	objects []runtime.Object
+}
+
+func newFixture(t *testing.T) *fixture {
+	return &fixture{t: t}
+}
+
+func (f *fixture) newController() *Controller {
+	for _, s := range f.serviceLister {
+		f.objects = append(f.objects, s)
+	}
+	for _, i := range f.ingressLister {
+		f.objects = append(f.objects, i)
+	}
+	f.client = fake.NewSimpleClientset(f.objects...)
+
+	factory := informers.NewSharedInformerFactory(f.client, 0)
+	serviceInformer := factory.Core().V1().Services()
+	ingressInformer := factory.Networking().V1().Ingresses()
+
+	c := NewController(f.client, serviceInformer, ingressInformer)
+
+	for _, s := range f.serviceLister {
+		if err := serviceInformer.Informer().GetIndexer().Add(s); err != nil {
+			f.t.Fatalf("failed to seed service %s: %v", s.Name, err)
+		}
+	}
+	for _, i := range f.ingressLister {
+		if err := ingressInformer.Informer().GetIndexer().Add(i); err != nil {
+			f.t.Fatalf("failed to seed ingress %s: %v", i.Name, err)
+		}
+	}
+
+	f.t.Cleanup(c.queue.ShutDown)
+	return &c
+}
+
+// checkActions verifies the client saw exactly the expected verb/resource pairs.
+func (f *fixture) checkActions(expected []core.Action) {
+	actions := f.client.Actions()
+	if len(actions) != len(expected) {
+		f.t.Fatalf("expected %d actions, got %d: %+v", len(expected), len(actions), actions)
+	}
+
+	for i, action := range actions {
+		e := expected[i]
+		if !action.Matches(e.GetVerb(), e.GetResource().Resource) || action.GetNamespace() != e.GetNamespace() {
+			f.t.Errorf("expected action %+v, got %+v", e, action)
+			continue
+		}
+
+		switch a := action.(type) {
+		case core.CreateAction:
+			ingress, ok := a.GetObject().(*v15.Ingress)
+			if !ok {
+				f.t.Errorf("expected ingress to be created, got %T", a.GetObject())
+				continue
+			}
+			if ingress.Name != e.(core.CreateAction).GetObject().(*v15.Ingress).Name {
+				f.t.Errorf("expected ingress %s to be created, got %s",
+					e.(core.CreateAction).GetObject().(*v15.Ingress).Name, ingress.Name)
+			}
+		case core.DeleteAction:
+			if a.GetName() != e.(core.DeleteAction).GetName() {
+				f.t.Errorf("expected ingress %s to be deleted, got %s", e.(core.DeleteAction).GetName(), a.GetName())
+			}
+		}
+	}
+}
+
+func newService(name string, annotations map[string]string) *v17.Service {
+	return &v17.Service{
+		TypeMeta: v16.TypeMeta{APIVersion: v17.SchemeGroupVersion.String(), Kind: "Service"},
+		ObjectMeta: v16.ObjectMeta{
+			Name:        name,
+			Namespace:   v16.NamespaceDefault,
+			UID:         types.UID(name + "-uid"),
+			Annotations: annotations,
+		},
+	}
+}
+
+func newIngress(name string, owner *v16.OwnerReference) *v15.Ingress {
+	ingress := &v15.Ingress{
+		TypeMeta: v16.TypeMeta{APIVersion: v15.SchemeGroupVersion.String(), Kind: "Ingress"},
+		ObjectMeta: v16.ObjectMeta{
+			Name:      name,
+			Namespace: v16.NamespaceDefault,
+		},
+	}
+	if owner != nil {
+		ingress.OwnerReferences = []v16.OwnerReference{*owner}
+	}
+	return ingress
+}
+
+func ownedBy(service *v17.Service) *v16.OwnerReference {
+	return v16.NewControllerRef(service, v17.SchemeGroupVersion.WithKind("Service"))
+}
+
+func getKey(obj interface{}, t *testing.T) string {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		t.Fatalf("unexpected error getting key for %v: %v", obj, err)
+	}
+	return key
+}
+
+func expectCreateIngress(ingress *v15.Ingress) core.Action {
+	return core.NewCreateAction(v15.SchemeGroupVersion.WithResource("ingresses"), ingress.Namespace, ingress)
+}
+
+func expectDeleteIngress(ingress *v15.Ingress) core.Action {
+	return core.NewDeleteAction(v15.SchemeGroupVersion.WithResource("ingresses"), ingress.Namespace, ingress.Name)
+}
+
+func TestSyncServiceCreatesIngress(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", map[string]string{"ingress/http": "true"})
+	f.serviceLister = append(f.serviceLister, service)
+
+	c := f.newController()
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.checkActions([]core.Action{expectCreateIngress(newIngress("foo", ownedBy(service)))})
+}
+
+func TestSyncServiceKeepsExistingIngress(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", map[string]string{"ingress/http": "true"})
+	ingress, err := (&Controller{}).constructIngress(service, &Defaults{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.serviceLister = append(f.serviceLister, service)
+	f.ingressLister = append(f.ingressLister, ingress)
+
+	c := f.newController()
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.checkActions(nil)
+}
+
+func TestSyncServiceDeletesIngress(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", nil)
+	ingress := newIngress("foo", ownedBy(service))
+	f.serviceLister = append(f.serviceLister, service)
+	f.ingressLister = append(f.ingressLister, ingress)
+
+	c := f.newController()
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.checkActions([]core.Action{expectDeleteIngress(ingress)})
+}
+
+func TestSyncServiceWithoutAnnotationOrIngress(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", map[string]string{"ingress/http": "false"})
+	f.serviceLister = append(f.serviceLister, service)
+
+	c := f.newController()
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.checkActions(nil)
+}
+
+func TestSyncServiceIgnoresForeignIngress(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", nil)
+	other := newService("bar", nil)
+	f.serviceLister = append(f.serviceLister, service)
+	f.ingressLister = append(f.ingressLister, newIngress("foo", ownedBy(other)))
+
+	c := f.newController()
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.checkActions(nil)
+}
+
+func TestSyncServiceMissingService(t *testing.T) {
+	f := newFixture(t)
+
+	c := f.newController()
+	if err := c.syncService(v16.NamespaceDefault + "/missing"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.checkActions(nil)
+}
+
+func TestProcessNextItemRequeuesOnAPIError(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", map[string]string{"ingress/http": "true"})
+	f.serviceLister = append(f.serviceLister, service)
+
+	c := f.newController()
+	f.client.PrependReactor("create", "ingresses", func(action core.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("injected create error")
+	})
+	key := getKey(service, t)
+	c.queue.Add(key)
+
+	if !c.processNextItem() {
+		t.Fatalf("expected worker to keep running")
+	}
+	if got := c.queue.NumRequeues(key); got != 1 {
+		t.Errorf("expected key %s to be requeued once, got %d", key, got)
+	}
+
+	f.checkActions([]core.Action{expectCreateIngress(newIngress("foo", ownedBy(service)))})
+}
+
+func TestSyncServiceIgnoresUnownedIngress(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", nil)
+	f.serviceLister = append(f.serviceLister, service)
+	f.ingressLister = append(f.ingressLister, newIngress("foo", nil))
+
+	c := f.newController()
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.checkActions(nil)
+}
+
+func TestSyncServiceOutsideScope(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", map[string]string{"ingress/http": "true"})
+	f.serviceLister = append(f.serviceLister, service)
+
+	c := f.newController()
+	c.SetScope(Scope{ExcludeNamespaces: []string{v16.NamespaceDefault}})
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.checkActions(nil)
+}
+
+func TestSyncServiceIngressClass(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", map[string]string{"ingress/http": "true", classAnnotation: "internal"})
+	f.serviceLister = append(f.serviceLister, service)
+
+	c := f.newController()
+	c.SetScope(Scope{IngressClass: "internal"})
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.checkActions([]core.Action{expectCreateIngress(newIngress("foo", ownedBy(service)))})
+	ingress := f.client.Actions()[0].(core.CreateAction).GetObject().(*v15.Ingress)
+	if ingress.Spec.IngressClassName == nil || *ingress.Spec.IngressClassName != "internal" {
+		t.Errorf("expected ingressClassName internal, got %v", ingress.Spec.IngressClassName)
+	}
+}
+
+func TestSyncServiceOtherIngressClass(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", map[string]string{"ingress/http": "true", classAnnotation: "public"})
+	// created by the instance owning the public class
+	ingress := newIngress("foo", ownedBy(service))
+	ingress.Annotations = map[string]string{classAnnotation: "public"}
+	f.serviceLister = append(f.serviceLister, service)
+	f.ingressLister = append(f.ingressLister, ingress)
+
+	c := f.newController()
+	c.SetScope(Scope{IngressClass: "internal"})
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	f.checkActions(nil)
+}
+
+func TestSyncServiceKeepsForeignAnnotations(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", map[string]string{"ingress/http": "true"})
+	ingress, err := (&Controller{}).constructIngress(service, &Defaults{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := ingress.Annotations[classAnnotation]; ok {
+		t.Errorf("expected no %s annotation without an ingress class, got %v", classAnnotation, ingress.Annotations)
+	}
+	// added by another tool
+	ingress.Annotations = map[string]string{"cert-manager.io/cluster-issuer": "letsencrypt"}
+	f.serviceLister = append(f.serviceLister, service)
+	f.ingressLister = append(f.ingressLister, ingress)
+
+	c := f.newController()
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.checkActions(nil)
+}
+
+func TestDeleteIngressTombstone(t *testing.T) {
+	f := newFixture(t)
+	service := newService("foo", nil)
+	ingress := newIngress("foo", ownedBy(service))
+
+	c := f.newController()
+	c.deleteIngress(cache.DeletedFinalStateUnknown{Key: getKey(ingress, t), Obj: ingress})
+
+	if got := c.queue.Len(); got != 1 {
+		t.Errorf("expected the ingress key to be queued, got %d items", got)
+	}
+}
@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	v17 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	v13 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// keys read from the defaults ConfigMap
+const (
+	hostTemplateKey     = "host"
+	ingressClassNameKey = "ingressClassName"
+	tlsSecretKey        = "tlsSecret"
+	annotationsKey      = "annotations"
+)
+
+const defaultHost = "example.com"
+
+// Defaults holds the cluster wide settings used to render generated resources.
+type Defaults struct {
+	// HostTemplate is executed with the Service, e.g. {{.Name}}.{{.Namespace}}.apps.example.com
+	HostTemplate     *template.Template
+	IngressClassName string
+	TLSSecret        string
+	Annotations      map[string]string
+}
+
+// ParseDefaults reads Defaults from a ConfigMap. The annotations key holds a YAML map.
+func ParseDefaults(cm *v17.ConfigMap) (*Defaults, error) {
+	d := &Defaults{
+		IngressClassName: cm.Data[ingressClassNameKey],
+		TLSSecret:        cm.Data[tlsSecretKey],
+	}
+
+	if host := cm.Data[hostTemplateKey]; host != "" {
+		tmpl, err := template.New(hostTemplateKey).Option("missingkey=error").Parse(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s template in configmap %s/%s: %w", hostTemplateKey, cm.Namespace, cm.Name, err)
+		}
+		d.HostTemplate = tmpl
+	}
+
+	if annotations := cm.Data[annotationsKey]; annotations != "" {
+		if err := yaml.Unmarshal([]byte(annotations), &d.Annotations); err != nil {
+			return nil, fmt.Errorf("invalid %s in configmap %s/%s: %w", annotationsKey, cm.Namespace, cm.Name, err)
+		}
+	}
+
+	return d, nil
+}
+
+// Host returns the ingress/host annotation of service, or renders the host template,
+// falling back to example.com without a template.
+func (d *Defaults) Host(service *v17.Service) (string, error) {
+	if host := service.GetAnnotations()[hostAnnotation]; host != "" {
+		return host, nil
+	}
+	if d.HostTemplate == nil {
+		return defaultHost, nil
+	}
+	var buf bytes.Buffer
+	if err := d.HostTemplate.Execute(&buf, service); err != nil {
+		return "", fmt.Errorf("failed to render host for service %s/%s: %w", service.Namespace, service.Name, err)
+	}
+	return buf.String(), nil
+}
+
+// WatchDefaults makes the controller render resources from the named ConfigMap.
+// Every change to the ConfigMap requeues all annotated Services.
+func (c *Controller) WatchDefaults(configMapInformer v13.ConfigMapInformer, namespace, name string) {
+	c.configMapLister = configMapInformer.Lister()
+	c.configMapSynced = configMapInformer.Informer().HasSynced
+	c.configMapNamespace = namespace
+	c.configMapName = name
+
+	configMapInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool {
+			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+			return err == nil && key == namespace+"/"+name
+		},
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: c.enqueueAnnotatedServices,
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				c.enqueueAnnotatedServices(newObj)
+			},
+			DeleteFunc: c.enqueueAnnotatedServices,
+		},
+	})
+}
+
+func (c *Controller) enqueueAnnotatedServices(interface{}) {
+	services, err := c.serviceLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("failed to list services: %s", err.Error())
+		return
+	}
+	for _, service := range services {
+		if service.GetAnnotations()["ingress/http"] == "true" {
+			c.enqueue(service)
+		}
+	}
+}
+
+// defaults returns the current cluster defaults, empty when no ConfigMap is configured or present.
+func (c *Controller) defaults() (*Defaults, error) {
+	if c.configMapLister == nil {
+		return &Defaults{}, nil
+	}
+	cm, err := c.configMapLister.ConfigMaps(c.configMapNamespace).Get(c.configMapName)
+	if errors.IsNotFound(err) {
+		return &Defaults{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseDefaults(cm)
+}
@@ -0,0 +1,165 @@
+package pkg
+
+import (
+	"testing"
+
+	v17 "k8s.io/api/core/v1"
+	v15 "k8s.io/api/networking/v1"
+	v16 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+)
+
+func newDefaultsConfigMap(data map[string]string) *v17.ConfigMap {
+	return &v17.ConfigMap{
+		ObjectMeta: v16.ObjectMeta{
+			Name:      "ingress-defaults",
+			Namespace: "kube-system",
+		},
+		Data: data,
+	}
+}
+
+func TestParseDefaults(t *testing.T) {
+	d, err := ParseDefaults(newDefaultsConfigMap(map[string]string{
+		hostTemplateKey:     "{{.Name}}.{{.Namespace}}.apps.example.com",
+		ingressClassNameKey: "nginx",
+		tlsSecretKey:        "wildcard-tls",
+		annotationsKey:      "nginx.ingress.kubernetes.io/ssl-redirect: \"true\"\n",
+	}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	host, err := d.Host(newService("foo", nil))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if host != "foo.default.apps.example.com" {
+		t.Errorf("expected host foo.default.apps.example.com, got %s", host)
+	}
+	if d.IngressClassName != "nginx" || d.TLSSecret != "wildcard-tls" {
+		t.Errorf("unexpected defaults %+v", d)
+	}
+	if d.Annotations["nginx.ingress.kubernetes.io/ssl-redirect"] != "true" {
+		t.Errorf("unexpected annotations %v", d.Annotations)
+	}
+}
+
+func TestParseDefaultsInvalid(t *testing.T) {
+	for _, data := range []map[string]string{
+		{hostTemplateKey: "{{.Name"},
+		{annotationsKey: "- not a map"},
+	} {
+		if _, err := ParseDefaults(newDefaultsConfigMap(data)); err == nil {
+			t.Errorf("expected error for %v", data)
+		}
+	}
+}
+
+func TestSyncServiceRendersDefaults(t *testing.T) {
+	cm := newDefaultsConfigMap(map[string]string{
+		hostTemplateKey:     "{{.Name}}.{{.Namespace}}.apps.example.com",
+		ingressClassNameKey: "nginx",
+		tlsSecretKey:        "wildcard-tls",
+		annotationsKey:      "nginx.ingress.kubernetes.io/ssl-redirect: \"true\"\n",
+	})
+	service := newService("foo", map[string]string{"ingress/http": "true"})
+	// created before the defaults existed
+	ingress, err := (&Controller{}).constructIngress(service, &Defaults{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// added by another tool
+	ingress.Annotations = map[string]string{"cert-manager.io/cluster-issuer": "letsencrypt"}
+
+	client := fake.NewSimpleClientset([]runtime.Object{service, ingress}...)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	serviceInformer := factory.Core().V1().Services()
+	ingressInformer := factory.Networking().V1().Ingresses()
+	configMapInformer := factory.Core().V1().ConfigMaps()
+
+	c := NewController(client, serviceInformer, ingressInformer)
+	t.Cleanup(c.queue.ShutDown)
+	c.WatchDefaults(configMapInformer, cm.Namespace, cm.Name)
+
+	_ = serviceInformer.Informer().GetIndexer().Add(service)
+	_ = ingressInformer.Informer().GetIndexer().Add(ingress)
+	_ = configMapInformer.Informer().GetIndexer().Add(cm)
+
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actions := client.Actions()
+	if len(actions) != 1 || !actions[0].Matches("update", "ingresses") {
+		t.Fatalf("expected a single ingress update, got %+v", actions)
+	}
+	updated := actions[0].(core.UpdateAction).GetObject().(*v15.Ingress)
+	if host := updated.Spec.Rules[0].Host; host != "foo.default.apps.example.com" {
+		t.Errorf("expected rendered host, got %s", host)
+	}
+	if updated.Spec.IngressClassName == nil || *updated.Spec.IngressClassName != "nginx" {
+		t.Errorf("expected ingressClassName nginx, got %v", updated.Spec.IngressClassName)
+	}
+	if len(updated.Spec.TLS) != 1 || updated.Spec.TLS[0].SecretName != "wildcard-tls" {
+		t.Errorf("expected default tls secret, got %+v", updated.Spec.TLS)
+	}
+	if updated.Annotations["nginx.ingress.kubernetes.io/ssl-redirect"] != "true" || updated.Annotations["cert-manager.io/cluster-issuer"] != "letsencrypt" {
+		t.Errorf("expected the default annotations merged into the existing ones, got %v", updated.Annotations)
+	}
+}
+
+func TestSyncServiceDefaultClassChange(t *testing.T) {
+	cm := newDefaultsConfigMap(map[string]string{ingressClassNameKey: "traefik"})
+	service := newService("foo", nil)
+	// created while the default class was still nginx
+	ingress, err := (&Controller{}).constructIngress(service, &Defaults{IngressClassName: "nginx"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client := fake.NewSimpleClientset([]runtime.Object{service, ingress}...)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	serviceInformer := factory.Core().V1().Services()
+	ingressInformer := factory.Networking().V1().Ingresses()
+	configMapInformer := factory.Core().V1().ConfigMaps()
+
+	c := NewController(client, serviceInformer, ingressInformer)
+	t.Cleanup(c.queue.ShutDown)
+	c.WatchDefaults(configMapInformer, cm.Namespace, cm.Name)
+
+	_ = serviceInformer.Informer().GetIndexer().Add(service)
+	_ = ingressInformer.Informer().GetIndexer().Add(ingress)
+	_ = configMapInformer.Informer().GetIndexer().Add(cm)
+
+	// the annotation is gone, the ingress must still be recognised as ours and deleted
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actions := client.Actions()
+	if len(actions) != 1 || !actions[0].Matches("delete", "ingresses") {
+		t.Fatalf("expected a single ingress delete, got %+v", actions)
+	}
+}
+
+func TestDefaultsChangeEnqueuesAnnotatedServices(t *testing.T) {
+	f := newFixture(t)
+	f.serviceLister = append(f.serviceLister,
+		newService("foo", map[string]string{"ingress/http": "true"}),
+		newService("bar", nil))
+
+	c := f.newController()
+	c.enqueueAnnotatedServices(newDefaultsConfigMap(nil))
+
+	if got := c.queue.Len(); got != 1 {
+		t.Fatalf("expected one service to be enqueued, got %d", got)
+	}
+	item, _ := c.queue.Get()
+	if item != v16.NamespaceDefault+"/foo" {
+		t.Errorf("expected default/foo to be enqueued, got %v", item)
+	}
+}
@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	v17 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v16 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// gatewayAnnotation names the parent Gateway of the generated HTTPRoute, as "name" or "namespace/name".
+const gatewayAnnotation = "ingress/gateway"
+
+// HTTPRouteResource is the Gateway API resource managed in httproute output mode.
+var HTTPRouteResource = schema.GroupVersionResource{
+	Group:    "gateway.networking.k8s.io",
+	Version:  "v1",
+	Resource: "httproutes",
+}
+
+func (c *Controller) deleteHTTPRoute(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	route, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+	// get OwnerReference
+	ownerReference := v16.GetControllerOf(route)
+
+	if ownerReference == nil || ownerReference.Kind != "Service" {
+		return
+	}
+
+	c.enqueue(obj)
+}
+
+func (c *Controller) syncHTTPRoute(service *v17.Service, v string) error {
+	namespace, name := service.Namespace, service.Name
+
+	defaults, err := c.defaults()
+	if err != nil {
+		return err
+	}
+
+	obj, err := c.routeLister.ByNamespace(namespace).Get(name)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+
+	var route *unstructured.Unstructured
+	if err == nil {
+		r, ok := obj.(*unstructured.Unstructured)
+		if ok && v16.IsControlledBy(r, service) && r.GetAnnotations()[classAnnotation] == c.scope.IngressClass {
+			route = r
+		}
+	}
+
+	if v == "true" && errors.IsNotFound(err) {
+		// create httproute
+		routeObj, err := c.constructHTTPRoute(service, defaults)
+		if err != nil {
+			return err
+		}
+		if routeObj == nil {
+			klog.Warningf("service %s in %s has no %s annotation, skip creating httproute", name, namespace, gatewayAnnotation)
+			c.event(service, v17.EventTypeWarning, "MissingGateway",
+				fmt.Sprintf("no HTTPRoute created, the %s annotation must name the parent Gateway", gatewayAnnotation))
+			return nil
+		}
+		klog.Infof("creating httproute %s in %s", name, namespace)
+		_, err = c.dynamicClient.Resource(HTTPRouteResource).Namespace(namespace).Create(context.TODO(), routeObj, v16.CreateOptions{})
+		if err != nil {
+			klog.Errorf("failed to create httproute %s in %s", name, namespace)
+			return err
+		}
+	} else if v == "true" && route != nil {
+		// update httproute when the defaults or the gateway changed
+		routeObj, err := c.constructHTTPRoute(service, defaults)
+		if err != nil {
+			return err
+		}
+		if routeObj == nil {
+			c.event(service, v17.EventTypeWarning, "MissingGateway",
+				fmt.Sprintf("HTTPRoute not updated, the %s annotation must name the parent Gateway", gatewayAnnotation))
+			return nil
+		}
+		if specContains(route.Object["spec"], routeObj.Object["spec"]) {
+			return nil
+		}
+		routeCopy := route.DeepCopy()
+		routeCopy.Object["spec"] = routeObj.Object["spec"]
+		klog.Infof("updating httproute %s in %s", name, namespace)
+		_, err = c.dynamicClient.Resource(HTTPRouteResource).Namespace(namespace).Update(context.TODO(), routeCopy, v16.UpdateOptions{})
+		if err != nil {
+			klog.Errorf("failed to update httproute %s in %s", name, namespace)
+			return err
+		}
+	} else if v != "true" && route != nil {
+		// delete httproute
+		klog.Infof("deleting httproute %s in %s", name, namespace)
+		err := c.dynamicClient.Resource(HTTPRouteResource).Namespace(namespace).Delete(context.TODO(), name, v16.DeleteOptions{})
+		if err != nil {
+			klog.Errorf("failed to delete httproute %s in %s", name, namespace)
+			return err
+		}
+	}
+	return nil
+}
+
+// constructHTTPRoute mirrors constructIngress for the Gateway API. It returns nil
+// when the Service does not name a parent Gateway.
+func (c *Controller) constructHTTPRoute(service *v17.Service, defaults *Defaults) (*unstructured.Unstructured, error) {
+	gateway := service.GetAnnotations()[gatewayAnnotation]
+	if gateway == "" {
+		return nil, nil
+	}
+
+	host, err := defaults.Host(service)
+	if err != nil {
+		return nil, err
+	}
+	port, err := backendPort(service)
+	if err != nil {
+		return nil, err
+	}
+	// backendRefs only accept port numbers
+	if port.Name != "" {
+		for _, p := range service.Spec.Ports {
+			if p.Name == port.Name {
+				port.Number = p.Port
+			}
+		}
+		if port.Number == 0 {
+			return nil, fmt.Errorf("service %s/%s has no port named %s", service.Namespace, service.Name, port.Name)
+		}
+	}
+
+	// the namespace is always set, so that moving the Gateway to the Service namespace updates the route
+	parentRef := map[string]interface{}{
+		"namespace": service.Namespace,
+		"name":      gateway,
+	}
+	if gatewayNamespace, gatewayName, found := strings.Cut(gateway, "/"); found {
+		parentRef["namespace"] = gatewayNamespace
+		parentRef["name"] = gatewayName
+	}
+
+	ownerReference := v16.NewControllerRef(service, v17.SchemeGroupVersion.WithKind("Service"))
+
+	route := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"parentRefs": []interface{}{parentRef},
+				"hostnames":  []interface{}{host},
+				"rules": []interface{}{
+					map[string]interface{}{
+						"matches": []interface{}{
+							map[string]interface{}{
+								"path": map[string]interface{}{
+									"type":  "PathPrefix",
+									"value": "/",
+								},
+							},
+						},
+						"backendRefs": []interface{}{
+							map[string]interface{}{
+								"name": service.Name,
+								"port": int64(port.Number),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	route.SetAPIVersion(HTTPRouteResource.GroupVersion().String())
+	route.SetKind("HTTPRoute")
+	route.SetName(service.Name)
+	route.SetNamespace(service.Namespace)
+	route.SetOwnerReferences([]v16.OwnerReference{*ownerReference})
+	if c.scope.IngressClass != "" {
+		route.SetAnnotations(map[string]string{classAnnotation: c.scope.IngressClass})
+	}
+	return route, nil
+}
+
+// specContains reports whether every field set in desired has the same value in live. The API server
+// defaults fields of parentRefs and backendRefs (group, kind, weight), which constructHTTPRoute leaves
+// out, so comparing whole specs would update the HTTPRoute on every sync.
+func specContains(live, desired interface{}) bool {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, value := range d {
+			if !specContains(l[key], value) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return false
+		}
+		for i := range d {
+			if !specContains(l[i], d[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return equality.Semantic.DeepEqual(live, desired)
+	}
+}
@@ -0,0 +1,153 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+
+	v17 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	core "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func newHTTPRouteController(t *testing.T, service *v17.Service, routes ...*unstructured.Unstructured) (*Controller, *dynamicfake.FakeDynamicClient) {
+	objects := make([]runtime.Object, 0, len(routes))
+	for _, r := range routes {
+		objects = append(objects, r)
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{HTTPRouteResource: "HTTPRouteList"}, objects...)
+	client := fake.NewSimpleClientset(service)
+
+	factory := informers.NewSharedInformerFactory(client, 0)
+	dynamicFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
+	serviceInformer := factory.Core().V1().Services()
+	routeInformer := dynamicFactory.ForResource(HTTPRouteResource)
+
+	c := NewHTTPRouteController(client, dynamicClient, serviceInformer, routeInformer)
+
+	if err := serviceInformer.Informer().GetIndexer().Add(service); err != nil {
+		t.Fatalf("failed to seed service %s: %v", service.Name, err)
+	}
+	for _, r := range routes {
+		if err := routeInformer.Informer().GetIndexer().Add(r); err != nil {
+			t.Fatalf("failed to seed httproute %s: %v", r.GetName(), err)
+		}
+	}
+
+	t.Cleanup(c.queue.ShutDown)
+	return &c, dynamicClient
+}
+
+func TestSyncServiceCreatesHTTPRoute(t *testing.T) {
+	service := newService("foo", map[string]string{"ingress/http": "true", gatewayAnnotation: "infra/shared"})
+	c, dynamicClient := newHTTPRouteController(t, service)
+
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actions := dynamicClient.Actions()
+	if len(actions) != 1 || !actions[0].Matches("create", "httproutes") {
+		t.Fatalf("expected a single httproute create, got %+v", actions)
+	}
+	route := actions[0].(core.CreateAction).GetObject().(*unstructured.Unstructured)
+	parentRefs, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	if len(parentRefs) != 1 {
+		t.Fatalf("expected one parentRef, got %v", parentRefs)
+	}
+	parentRef := parentRefs[0].(map[string]interface{})
+	if parentRef["namespace"] != "infra" || parentRef["name"] != "shared" {
+		t.Errorf("expected parentRef infra/shared, got %v", parentRef)
+	}
+}
+
+func TestSyncServiceSkipsHTTPRouteWithoutGateway(t *testing.T) {
+	service := newService("foo", map[string]string{"ingress/http": "true"})
+	c, dynamicClient := newHTTPRouteController(t, service)
+	recorder := record.NewFakeRecorder(1)
+	c.SetRecorder(recorder)
+
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if actions := dynamicClient.Actions(); len(actions) != 0 {
+		t.Errorf("expected no actions, got %+v", actions)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, "MissingGateway") {
+			t.Errorf("expected a MissingGateway event, got %q", event)
+		}
+	default:
+		t.Errorf("expected a MissingGateway event")
+	}
+}
+
+func TestSyncServiceKeepsDefaultedHTTPRoute(t *testing.T) {
+	service := newService("foo", map[string]string{"ingress/http": "true", gatewayAnnotation: "shared"})
+	route, err := (&Controller{}).constructHTTPRoute(service, &Defaults{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// fields defaulted by the API server
+	rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+	backendRef := rules[0].(map[string]interface{})["backendRefs"].([]interface{})[0].(map[string]interface{})
+	backendRef["group"], backendRef["kind"], backendRef["weight"] = "", "Service", int64(1)
+	parentRefs, _, _ := unstructured.NestedSlice(route.Object, "spec", "parentRefs")
+	parentRef := parentRefs[0].(map[string]interface{})
+	parentRef["group"], parentRef["kind"] = "gateway.networking.k8s.io", "Gateway"
+	c, dynamicClient := newHTTPRouteController(t, service, route)
+
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if actions := dynamicClient.Actions(); len(actions) != 0 {
+		t.Errorf("expected no actions, got %+v", actions)
+	}
+}
+
+func TestSyncServiceUpdatesHTTPRouteGateway(t *testing.T) {
+	route, err := (&Controller{}).constructHTTPRoute(newService("foo", map[string]string{gatewayAnnotation: "infra/shared"}), &Defaults{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	service := newService("foo", map[string]string{"ingress/http": "true", gatewayAnnotation: "shared"})
+	c, dynamicClient := newHTTPRouteController(t, service, route)
+
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actions := dynamicClient.Actions()
+	if len(actions) != 1 || !actions[0].Matches("update", "httproutes") {
+		t.Fatalf("expected a single httproute update, got %+v", actions)
+	}
+}
+
+func TestSyncServiceDeletesHTTPRoute(t *testing.T) {
+	annotated := newService("foo", map[string]string{gatewayAnnotation: "shared"})
+	route, err := (&Controller{}).constructHTTPRoute(annotated, &Defaults{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	service := newService("foo", nil)
+	c, dynamicClient := newHTTPRouteController(t, service, route)
+
+	if err := c.syncService(getKey(service, t)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actions := dynamicClient.Actions()
+	if len(actions) != 1 || !actions[0].Matches("delete", "httproutes") {
+		t.Fatalf("expected a single httproute delete, got %+v", actions)
+	}
+}
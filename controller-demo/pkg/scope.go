@@ -0,0 +1,44 @@
+package pkg
+
+import (
+	v17 "k8s.io/api/core/v1"
+)
+
+// classAnnotation selects which controller instance handles a Service.
+const classAnnotation = "ingress/class"
+
+// Scope restricts the Services handled by a controller instance, so that
+// several instances can run side by side in one cluster.
+type Scope struct {
+	// Namespaces is an allowlist; empty means every namespace.
+	Namespaces []string
+	// ExcludeNamespaces is a denylist applied after Namespaces.
+	ExcludeNamespaces []string
+	// IngressClass is the class this instance owns. Services must request it
+	// through the ingress/class annotation; with an empty class only Services
+	// without the annotation are handled.
+	IngressClass string
+}
+
+// InNamespace reports whether namespace is watched by this scope.
+func (s Scope) InNamespace(namespace string) bool {
+	for _, ns := range s.ExcludeNamespaces {
+		if ns == namespace {
+			return false
+		}
+	}
+	if len(s.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range s.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Requests reports whether service asks for the class owned by this scope.
+func (s Scope) Requests(service *v17.Service) bool {
+	return service.GetAnnotations()[classAnnotation] == s.IngressClass
+}
@@ -0,0 +1,28 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestScopeInNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		scope     Scope
+		namespace string
+		want      bool
+	}{
+		{name: "empty scope", scope: Scope{}, namespace: "default", want: true},
+		{name: "allowed", scope: Scope{Namespaces: []string{"a", "b"}}, namespace: "b", want: true},
+		{name: "not allowed", scope: Scope{Namespaces: []string{"a"}}, namespace: "b", want: false},
+		{name: "denied", scope: Scope{ExcludeNamespaces: []string{"kube-system"}}, namespace: "kube-system", want: false},
+		{name: "denied wins", scope: Scope{Namespaces: []string{"a"}, ExcludeNamespaces: []string{"a"}}, namespace: "a", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.scope.InNamespace(tt.namespace); got != tt.want {
+				t.Errorf("InNamespace(%q) = %v, want %v", tt.namespace, got, tt.want)
+			}
+		})
+	}
+}
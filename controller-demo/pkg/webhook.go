@@ -0,0 +1,254 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	v18 "k8s.io/api/admission/v1"
+	v17 "k8s.io/api/core/v1"
+	v15 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	v16 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/informers"
+	v14 "k8s.io/client-go/informers/networking/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+// hostIndex indexes Ingresses by the hosts of their rules and HTTPRoutes by their hostnames.
+const hostIndex = "host"
+
+// annotationPrefix marks the Services validated by the webhook.
+const annotationPrefix = "ingress/"
+
+// Webhook is a validating admission webhook for Services carrying ingress/* annotations.
+type Webhook struct {
+	controller     *Controller
+	ingressIndexer cache.Indexer
+	routeIndexer   cache.Indexer
+	synced         []cache.InformerSynced
+}
+
+// NewWebhook registers the host index on ingressInformer and, when not nil, routeInformer. It must be
+// called before the informers start. Hosts are unique across the cluster, so the informers should watch
+// all namespaces even when the controller is restricted to some: a host claimed in a namespace outside
+// the informers goes unnoticed.
+// The controller supplies the scope and the cluster defaults used to render hosts.
+func NewWebhook(controller *Controller, ingressInformer v14.IngressInformer, routeInformer informers.GenericInformer) (*Webhook, error) {
+	err := ingressInformer.Informer().AddIndexers(cache.Indexers{
+		hostIndex: func(obj interface{}) ([]string, error) {
+			ingress, ok := obj.(*v15.Ingress)
+			if !ok {
+				return nil, nil
+			}
+			var hosts []string
+			for _, rule := range ingress.Spec.Rules {
+				if rule.Host != "" {
+					hosts = append(hosts, rule.Host)
+				}
+			}
+			return hosts, nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Webhook{
+		controller:     controller,
+		ingressIndexer: ingressInformer.Informer().GetIndexer(),
+		synced:         []cache.InformerSynced{ingressInformer.Informer().HasSynced},
+	}
+	if routeInformer == nil {
+		return w, nil
+	}
+
+	err = routeInformer.Informer().AddIndexers(cache.Indexers{
+		hostIndex: func(obj interface{}) ([]string, error) {
+			route, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				return nil, nil
+			}
+			hosts, _, err := unstructured.NestedStringSlice(route.Object, "spec", "hostnames")
+			return hosts, err
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.routeIndexer = routeInformer.Informer().GetIndexer()
+	w.synced = append(w.synced, routeInformer.Informer().HasSynced)
+	return w, nil
+}
+
+// Run serves the webhook over TLS with tls.crt and tls.key from certDir until stopChan is closed.
+// It only starts serving once the informers have synced, an empty index would admit any host.
+func (w *Webhook) Run(addr, certDir string, stopChan <-chan struct{}) error {
+	klog.Info("waiting for webhook caches to sync")
+	synced := w.synced
+	if w.controller.configMapSynced != nil {
+		synced = append(synced, w.controller.configMapSynced)
+	}
+	if ok := cache.WaitForCacheSync(stopChan, synced...); !ok {
+		return fmt.Errorf("failed to wait for webhook caches to sync")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/validate-service", w)
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-stopChan
+		_ = server.Close()
+	}()
+
+	klog.Infof("serving webhook on %s", addr)
+	err := server.ListenAndServeTLS(filepath.Join(certDir, "tls.crt"), filepath.Join(certDir, "tls.key"))
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	review := v18.AdmissionReview{}
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(rw, "invalid admission review", http.StatusBadRequest)
+		return
+	}
+
+	response := &v18.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+
+	// only creates and updates carry the service, a DELETE arrives with an empty object
+	if op := review.Request.Operation; op == v18.Create || op == v18.Update {
+		service := &v17.Service{}
+		if err := json.Unmarshal(review.Request.Object.Raw, service); err != nil {
+			response.Allowed = false
+			response.Result = &v16.Status{Message: err.Error(), Reason: v16.StatusReasonBadRequest, Code: http.StatusBadRequest}
+		} else if err := w.validate(service); err != nil {
+			klog.Infof("rejecting service %s in %s: %s", service.Name, service.Namespace, err.Error())
+			response.Allowed = false
+			response.Result = &v16.Status{Message: err.Error(), Reason: v16.StatusReasonInvalid, Code: http.StatusUnprocessableEntity}
+		}
+	}
+
+	review.Response = response
+	review.Request = nil
+	out, err := json.Marshal(review)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	_, _ = rw.Write(out)
+}
+
+// validate rejects an invalid host, a port missing from the Service spec and a host claimed by another Service.
+// Explicit ingress/host and ingress/port annotations are always checked, the rendered defaults only when
+// an Ingress is requested.
+func (w *Webhook) validate(service *v17.Service) error {
+	if !hasIngressAnnotations(service) || !w.controller.scope.InNamespace(service.Namespace) || !w.controller.scope.Requests(service) {
+		return nil
+	}
+	annotations := service.GetAnnotations()
+	enabled := annotations["ingress/http"] == "true"
+
+	defaults, err := w.controller.defaults()
+	if err != nil {
+		return err
+	}
+
+	host, err := defaults.Host(service)
+	if err != nil {
+		return err
+	}
+	if enabled || annotations[hostAnnotation] != "" {
+		if errs := validateHost(host); len(errs) > 0 {
+			return fmt.Errorf("invalid host %q: %s", host, strings.Join(errs, ", "))
+		}
+	}
+
+	port, err := backendPort(service)
+	if err != nil {
+		return err
+	}
+	if (enabled || annotations[portAnnotation] != "") && !hasPort(service, port) {
+		return fmt.Errorf("port %s is not exposed by service %s", portString(port), service.Name)
+	}
+
+	if !enabled {
+		return nil
+	}
+	for _, indexer := range []cache.Indexer{w.ingressIndexer, w.routeIndexer} {
+		if indexer == nil {
+			continue
+		}
+		objs, err := indexer.ByIndex(hostIndex, host)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			claim, err := meta.Accessor(obj)
+			if err != nil {
+				return err
+			}
+			owner := v16.GetControllerOf(claim)
+			if claim.GetNamespace() == service.Namespace && owner != nil && owner.Kind == "Service" && owner.Name == service.Name {
+				continue
+			}
+			return fmt.Errorf("host %q is already claimed by %s %s/%s", host, kindOf(obj), claim.GetNamespace(), claim.GetName())
+		}
+	}
+	return nil
+}
+
+func kindOf(obj interface{}) string {
+	if _, ok := obj.(*v15.Ingress); ok {
+		return "ingress"
+	}
+	return "httproute"
+}
+
+func hasIngressAnnotations(service *v17.Service) bool {
+	for key := range service.GetAnnotations() {
+		if strings.HasPrefix(key, annotationPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateHost(host string) []string {
+	if strings.HasPrefix(host, "*.") {
+		return validation.IsWildcardDNS1123Subdomain(host)
+	}
+	return validation.IsDNS1123Subdomain(host)
+}
+
+func hasPort(service *v17.Service, port v15.ServiceBackendPort) bool {
+	for _, p := range service.Spec.Ports {
+		if port.Name != "" && p.Name == port.Name || port.Name == "" && p.Port == port.Number {
+			return true
+		}
+	}
+	return false
+}
+
+func portString(port v15.ServiceBackendPort) string {
+	if port.Name != "" {
+		return port.Name
+	}
+	return fmt.Sprint(port.Number)
+}
@@ -0,0 +1,208 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v18 "k8s.io/api/admission/v1"
+	v17 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestWebhook(t *testing.T) (*Webhook, *fake.Clientset) {
+	client := fake.NewSimpleClientset()
+	factory := informers.NewSharedInformerFactory(client, 0)
+	ingressInformer := factory.Networking().V1().Ingresses()
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{HTTPRouteResource: "HTTPRouteList"})
+	routeInformer := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0).ForResource(HTTPRouteResource)
+
+	c := NewController(client, factory.Core().V1().Services(), ingressInformer)
+	t.Cleanup(c.queue.ShutDown)
+
+	w, err := NewWebhook(&c, ingressInformer, routeInformer)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	claimed := newService("claimed", map[string]string{"ingress/http": "true", hostAnnotation: "taken.example.com"})
+	ingress, err := c.constructIngress(claimed, &Defaults{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ingressInformer.Informer().GetIndexer().Add(ingress); err != nil {
+		t.Fatalf("failed to seed ingress: %v", err)
+	}
+
+	routed := newService("routed", map[string]string{"ingress/http": "true", hostAnnotation: "route.example.com", gatewayAnnotation: "infra/shared"})
+	route, err := c.constructHTTPRoute(withPorts(routed, v17.ServicePort{Port: 80}), &Defaults{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := routeInformer.Informer().GetIndexer().Add(route); err != nil {
+		t.Fatalf("failed to seed httproute: %v", err)
+	}
+	return w, client
+}
+
+func withPorts(service *v17.Service, ports ...v17.ServicePort) *v17.Service {
+	service.Spec.Ports = ports
+	return service
+}
+
+func TestWebhookValidate(t *testing.T) {
+	httpPort := v17.ServicePort{Name: "http", Port: 80}
+	tests := []struct {
+		name    string
+		service *v17.Service
+		wantErr string
+	}{
+		{
+			name:    "no ingress annotations",
+			service: newService("foo", map[string]string{"app": "foo"}),
+		},
+		{
+			name:    "valid",
+			service: withPorts(newService("foo", map[string]string{"ingress/http": "true", hostAnnotation: "foo.example.com"}), httpPort),
+		},
+		{
+			name:    "port by name",
+			service: withPorts(newService("foo", map[string]string{"ingress/http": "true", hostAnnotation: "foo.example.com", portAnnotation: "http"}), httpPort),
+		},
+		{
+			name:    "invalid host",
+			service: withPorts(newService("foo", map[string]string{"ingress/http": "true", hostAnnotation: "Foo_bar"}), httpPort),
+			wantErr: "invalid host",
+		},
+		{
+			name:    "invalid host without ingress",
+			service: withPorts(newService("foo", map[string]string{hostAnnotation: "-foo"}), httpPort),
+			wantErr: "invalid host",
+		},
+		{
+			name:    "missing port",
+			service: withPorts(newService("foo", map[string]string{"ingress/http": "true", hostAnnotation: "foo.example.com", portAnnotation: "8080"}), httpPort),
+			wantErr: "port 8080 is not exposed",
+		},
+		{
+			name:    "missing default port",
+			service: newService("foo", map[string]string{"ingress/http": "true", hostAnnotation: "foo.example.com"}),
+			wantErr: "port 80 is not exposed",
+		},
+		{
+			name:    "host claimed by another service",
+			service: withPorts(newService("foo", map[string]string{"ingress/http": "true", hostAnnotation: "taken.example.com"}), httpPort),
+			wantErr: "already claimed",
+		},
+		{
+			name:    "host claimed by an httproute",
+			service: withPorts(newService("foo", map[string]string{"ingress/http": "true", hostAnnotation: "route.example.com"}), httpPort),
+			wantErr: "already claimed by httproute default/routed",
+		},
+		{
+			name:    "host claimed by its own httproute",
+			service: withPorts(newService("routed", map[string]string{"ingress/http": "true", hostAnnotation: "route.example.com"}), httpPort),
+		},
+		{
+			name:    "host claimed by itself",
+			service: withPorts(newService("claimed", map[string]string{"ingress/http": "true", hostAnnotation: "taken.example.com"}), httpPort),
+		},
+	}
+
+	w, _ := newTestWebhook(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := w.validate(tt.service)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestWebhookServeHTTP(t *testing.T) {
+	w, _ := newTestWebhook(t)
+
+	service := newService("foo", map[string]string{"ingress/http": "true", hostAnnotation: "taken.example.com"})
+	raw, err := json.Marshal(service)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	review := v18.AdmissionReview{
+		Request: &v18.AdmissionRequest{
+			UID:       "uid",
+			Operation: v18.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate-service", bytes.NewReader(body)))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	got := v18.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Response == nil || got.Response.UID != "uid" || got.Response.Allowed {
+		t.Fatalf("expected service to be rejected, got %+v", got.Response)
+	}
+}
+
+func TestWebhookServeHTTPDelete(t *testing.T) {
+	w, _ := newTestWebhook(t)
+
+	// the API server sends deletes without an object
+	review := v18.AdmissionReview{
+		Request: &v18.AdmissionRequest{
+			UID:       "uid",
+			Operation: v18.Delete,
+		},
+	}
+	body, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	w.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/validate-service", bytes.NewReader(body)))
+
+	got := v18.AdmissionReview{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Response == nil || !got.Response.Allowed {
+		t.Fatalf("expected delete to be allowed, got %+v", got.Response)
+	}
+}
+
+func TestWebhookRunWaitsForCacheSync(t *testing.T) {
+	w, _ := newTestWebhook(t)
+	stopChan := make(chan struct{})
+	close(stopChan)
+
+	// the informers never start, so the webhook must give up before serving
+	err := w.Run("127.0.0.1:0", t.TempDir(), stopChan)
+	if err == nil || !strings.Contains(err.Error(), "sync") {
+		t.Errorf("expected a cache sync error, got %v", err)
+	}
+}
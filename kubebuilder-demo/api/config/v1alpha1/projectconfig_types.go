@@ -0,0 +1,179 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+)
+
+// +kubebuilder:object:root=true
+
+// ProjectConfig is the Schema for the manager config file, it extends the controller-runtime
+// ControllerManagerConfiguration with the settings of the operator
+type ProjectConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ControllerManagerConfigurationSpec returns the configurations for controllers
+	cfg.ControllerManagerConfigurationSpec `json:",inline"`
+
+	// IngressClassName is the IngressClass of Apps and IngressGroups that do not set one
+	// +optional
+	IngressClassName string `json:"ingressClassName,omitempty"`
+	// IngressDomain is the domain of the default App hosts, <name>.<domain>
+	// +optional
+	IngressDomain string `json:"ingressDomain,omitempty"`
+	// MaxConcurrentReconciles is the number of Apps reconciled in parallel
+	// +optional
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles,omitempty"`
+	// MaxReplicas is the maximum spec.replicas accepted by the App validating webhook
+	// +optional
+	MaxReplicas int32 `json:"maxReplicas,omitempty"`
+	// ProtectServingApps rejects deleting Apps whose Ingress routes to ready replicas unless they
+	// are annotated ingress.mj.learn/force-delete=true
+	// +optional
+	ProtectServingApps bool `json:"protectServingApps,omitempty"`
+	// Namespaces restricts the manager to the Apps of these namespaces, all namespaces when empty
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// CacheManagedOnly restricts the cache of the owned kinds to the objects labelled as managed
+	// by the operator. Children created by older versions are read without the cache and labelled
+	// on their next reconcile, while unlabelled ones no longer wanted are left until their App
+	// is deleted
+	// +optional
+	CacheManagedOnly bool `json:"cacheManagedOnly,omitempty"`
+	// RateLimiter limits the requeues of failed Apps
+	// +optional
+	RateLimiter RateLimiterSpec `json:"rateLimiter,omitempty"`
+	// RoleRules bounds the rules Apps may grant to their ServiceAccount. The manager holds the
+	// escalate and bind verbs on Roles, so it can grant permissions it does not have itself
+	// +optional
+	RoleRules RoleRulesSpec `json:"roleRules,omitempty"`
+}
+
+// RateLimiterSpec configures a per App exponential backoff bounded by an overall token bucket,
+// zero values keep the controller-runtime defaults
+type RateLimiterSpec struct {
+	// BaseDelay is the requeue delay after the first failure, doubled on each further failure
+	// +optional
+	BaseDelay metav1.Duration `json:"baseDelay,omitempty"`
+	// MaxDelay caps the requeue delay of an App
+	// +optional
+	MaxDelay metav1.Duration `json:"maxDelay,omitempty"`
+	// QPS is the overall requeue rate
+	// +optional
+	QPS float64 `json:"qps,omitempty"`
+	// Burst is the bucket size of the overall requeue rate
+	// +optional
+	Burst int `json:"burst,omitempty"`
+}
+
+// RoleRulesSpec lists the verbs and resources spec.serviceAccount.rules of an App may grant,
+// empty lists keep the built-in allowlists
+type RoleRulesSpec struct {
+	// AllowedVerbs are the verbs a rule may use, "*" allows every verb
+	// +optional
+	AllowedVerbs []string `json:"allowedVerbs,omitempty"`
+	// AllowedResources are the resources a rule may use, written <resource> for the core group
+	// and <resource>.<group> otherwise, optionally followed by /<subresource>. "*" allows every resource
+	// +optional
+	AllowedResources []string `json:"allowedResources,omitempty"`
+}
+
+// Validate checks the operator settings and that they do not conflict with the embedded
+// ControllerManagerConfigurationSpec.
+func (c *ProjectConfig) Validate() error {
+	var allErrs field.ErrorList
+
+	if c.IngressClassName == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("ingressClassName"), ""))
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(c.IngressClassName) {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("ingressClassName"), c.IngressClassName, msg))
+	}
+	if c.IngressDomain == "" {
+		allErrs = append(allErrs, field.Required(field.NewPath("ingressDomain"), ""))
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(c.IngressDomain) {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("ingressDomain"), c.IngressDomain, msg))
+	}
+	if c.MaxConcurrentReconciles < 1 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("maxConcurrentReconciles"), c.MaxConcurrentReconciles, "must be at least 1"))
+	}
+	if c.MaxReplicas < 1 {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("maxReplicas"), c.MaxReplicas, "must be at least 1"))
+	}
+
+	rateLimiterPath := field.NewPath("rateLimiter")
+	if c.RateLimiter.BaseDelay.Duration < 0 {
+		allErrs = append(allErrs, field.Invalid(rateLimiterPath.Child("baseDelay"), c.RateLimiter.BaseDelay.Duration.String(), "must not be negative"))
+	}
+	if c.RateLimiter.MaxDelay.Duration < 0 || c.RateLimiter.MaxDelay.Duration > 0 && c.RateLimiter.MaxDelay.Duration < c.RateLimiter.BaseDelay.Duration {
+		allErrs = append(allErrs, field.Invalid(rateLimiterPath.Child("maxDelay"), c.RateLimiter.MaxDelay.Duration.String(), "must not be shorter than baseDelay"))
+	}
+	if c.RateLimiter.QPS < 0 {
+		allErrs = append(allErrs, field.Invalid(rateLimiterPath.Child("qps"), c.RateLimiter.QPS, "must not be negative"))
+	}
+	if c.RateLimiter.Burst < 0 {
+		allErrs = append(allErrs, field.Invalid(rateLimiterPath.Child("burst"), c.RateLimiter.Burst, "must not be negative"))
+	}
+
+	roleRulesPath := field.NewPath("roleRules")
+	allErrs = append(allErrs, validateList(c.RoleRules.AllowedVerbs, roleRulesPath.Child("allowedVerbs"))...)
+	allErrs = append(allErrs, validateList(c.RoleRules.AllowedResources, roleRulesPath.Child("allowedResources"))...)
+
+	seen := map[string]bool{}
+	for i, ns := range c.Namespaces {
+		for _, msg := range validation.IsDNS1123Label(ns) {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("namespaces").Index(i), ns, msg))
+		}
+		if seen[ns] {
+			allErrs = append(allErrs, field.Duplicate(field.NewPath("namespaces").Index(i), ns))
+		}
+		seen[ns] = true
+	}
+	if len(c.Namespaces) > 0 && c.CacheNamespace != "" {
+		allErrs = append(allErrs, field.Forbidden(field.NewPath("cacheNamespace"),
+			fmt.Sprintf("cannot be combined with namespaces %v", c.Namespaces)))
+	}
+
+	return allErrs.ToAggregate()
+}
+
+// validateList rejects empty and duplicate items.
+func validateList(items []string, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	seen := map[string]bool{}
+	for i, item := range items {
+		if item == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Index(i), ""))
+		}
+		if seen[item] {
+			allErrs = append(allErrs, field.Duplicate(fldPath.Index(i), item))
+		}
+		seen[item] = true
+	}
+	return allErrs
+}
+
+func init() {
+	SchemeBuilder.Register(&ProjectConfig{})
+}
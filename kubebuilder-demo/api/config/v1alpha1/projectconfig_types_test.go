@@ -0,0 +1,160 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/config"
+)
+
+func TestLoadManagerConfig(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	c := &ProjectConfig{}
+	loader := config.File().AtPath(filepath.Join("..", "..", "..", "config", "manager", "controller_manager_config.yaml")).OfKind(c)
+	if err := loader.InjectScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	spec, err := loader.Complete()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if spec.Webhook.Port == nil || *spec.Webhook.Port != 9443 {
+		t.Errorf("unexpected webhook config %+v", spec.Webhook)
+	}
+	if c.IngressClassName != "nginx" || c.IngressDomain != "mj.learn" || c.MaxConcurrentReconciles != 1 ||
+		c.MaxReplicas != 50 || c.ProtectServingApps || len(c.Namespaces) != 0 {
+		t.Errorf("unexpected operator config %+v", c)
+	}
+	if len(c.RoleRules.AllowedVerbs) != 3 || len(c.RoleRules.AllowedResources) != 4 {
+		t.Errorf("unexpected role rules %+v", c.RoleRules)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *ProjectConfig {
+		return &ProjectConfig{
+			IngressClassName:        "nginx",
+			IngressDomain:           "apps.example.com",
+			MaxConcurrentReconciles: 2,
+			MaxReplicas:             50,
+			Namespaces:              []string{"team-a", "team-b"},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		mutate  func(c *ProjectConfig)
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			mutate: func(c *ProjectConfig) {},
+		},
+		{
+			name:    "missing ingress class",
+			mutate:  func(c *ProjectConfig) { c.IngressClassName = "" },
+			wantErr: "ingressClassName",
+		},
+		{
+			name:    "invalid ingress domain",
+			mutate:  func(c *ProjectConfig) { c.IngressDomain = "Apps_Example" },
+			wantErr: "ingressDomain",
+		},
+		{
+			name:    "no concurrent reconciles",
+			mutate:  func(c *ProjectConfig) { c.MaxConcurrentReconciles = 0 },
+			wantErr: "maxConcurrentReconciles",
+		},
+		{
+			name:    "no replicas",
+			mutate:  func(c *ProjectConfig) { c.MaxReplicas = 0 },
+			wantErr: "maxReplicas",
+		},
+		{
+			name:    "duplicate namespace",
+			mutate:  func(c *ProjectConfig) { c.Namespaces = append(c.Namespaces, "team-a") },
+			wantErr: "namespaces[2]",
+		},
+		{
+			name: "rate limiter",
+			mutate: func(c *ProjectConfig) {
+				c.RateLimiter = RateLimiterSpec{BaseDelay: metav1.Duration{Duration: time.Second}, MaxDelay: metav1.Duration{Duration: time.Minute}, QPS: 5, Burst: 50}
+			},
+		},
+		{
+			name: "max delay shorter than base delay",
+			mutate: func(c *ProjectConfig) {
+				c.RateLimiter = RateLimiterSpec{BaseDelay: metav1.Duration{Duration: time.Minute}, MaxDelay: metav1.Duration{Duration: time.Second}}
+			},
+			wantErr: "rateLimiter.maxDelay",
+		},
+		{
+			name:    "negative qps",
+			mutate:  func(c *ProjectConfig) { c.RateLimiter.QPS = -1 },
+			wantErr: "rateLimiter.qps",
+		},
+		{
+			name: "role rules",
+			mutate: func(c *ProjectConfig) {
+				c.RoleRules = RoleRulesSpec{AllowedVerbs: []string{"get", "list"}, AllowedResources: []string{"pods", "deployments.apps"}}
+			},
+		},
+		{
+			name:    "duplicate role verb",
+			mutate:  func(c *ProjectConfig) { c.RoleRules.AllowedVerbs = []string{"get", "get"} },
+			wantErr: "roleRules.allowedVerbs[1]",
+		},
+		{
+			name:    "empty role resource",
+			mutate:  func(c *ProjectConfig) { c.RoleRules.AllowedResources = []string{""} },
+			wantErr: "roleRules.allowedResources[0]",
+		},
+		{
+			name:    "cache namespace and namespaces",
+			mutate:  func(c *ProjectConfig) { c.CacheNamespace = "team-a" },
+			wantErr: "cacheNamespace",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid()
+			tt.mutate(c)
+			err := c.Validate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
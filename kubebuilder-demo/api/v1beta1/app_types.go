@@ -1,28 +1,218 @@
 package v1beta1
 
 import (
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type AppSpec struct {
-	Image         string `json:"image"`
-	Replicas      int32  `json:"replicas"`
+	// Image is the shorthand for a single container named after the App, used when spec.containers
+	// is empty. When both are set it must match the image of the first container
+	// +optional
+	Image string `json:"image,omitempty"`
+	// Containers of the App Pods, the ConfigMaps and Secrets are mounted into the first one
+	// +optional
+	Containers []AppContainer `json:"containers,omitempty"`
+	// InitContainers run to completion before the Containers start
+	// +optional
+	InitContainers []AppContainer `json:"initContainers,omitempty"`
+	// Replicas defaults to 1 when unset, 0 keeps the Deployment scaled down
+	// +optional
+	// +kubebuilder:validation:Minimum=0
+	Replicas      *int32 `json:"replicas,omitempty"`
 	EnableService bool   `json:"enable_service"`
 	// +kubebuilder:default:enable_ingress=false
 	EnableIngress bool `json:"enable_ingress"`
+	// Suspended scales the Deployment to zero and removes the Ingress, clearing it restores both
+	// +optional
+	Suspended bool `json:"suspended,omitempty"`
+	// Schedules override Replicas from the last activation of one of them until the next,
+	// Replicas applies when none activated during the last five years
+	// +optional
+	Schedules []AppSchedule `json:"schedules,omitempty"`
+	// Port is the Service port, defaults to 80
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	Port int32 `json:"port,omitempty"`
+	// TargetPort is the container port traffic is sent to, defaults to Port
+	// +optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	TargetPort int32 `json:"targetPort,omitempty"`
+	// TargetPortName selects the container port traffic is sent to by name, it takes precedence over TargetPort
+	// +optional
+	TargetPortName string `json:"targetPortName,omitempty"`
+	// Ingress configures the Ingress created when enable_ingress is true
+	// +optional
+	Ingress AppIngress `json:"ingress,omitempty"`
+	// ConfigMaps are mounted into or exposed to the App container, the Pods are
+	// restarted when their content changes
+	// +optional
+	ConfigMaps []AppConfigSource `json:"configMaps,omitempty"`
+	// Secrets are mounted into or exposed to the App container, the Pods are
+	// restarted when their content changes
+	// +optional
+	Secrets []AppConfigSource `json:"secrets,omitempty"`
+	// NetworkPolicy isolates the App Pods, only the listed sources may connect to them.
+	// No NetworkPolicy is created when unset
+	// +optional
+	NetworkPolicy *AppNetworkPolicy `json:"networkPolicy,omitempty"`
+	// ServiceAccount runs the App Pods under a ServiceAccount of their own instead of the
+	// namespace default one
+	// +optional
+	ServiceAccount *AppServiceAccount `json:"serviceAccount,omitempty"`
+	// TemplateRef names a ConfigMap in the App namespace whose deployment.yaml, service.yaml,
+	// ingress.yaml and networkpolicy.yaml keys replace the built-in templates
+	// +optional
+	TemplateRef *corev1.LocalObjectReference `json:"templateRef,omitempty"`
 }
 
+// AppConfigSource references a ConfigMap or Secret in the App namespace, exactly one
+// of MountPath and EnvFrom must be set
+type AppConfigSource struct {
+	Name string `json:"name"`
+	// MountPath mounts every key as a file under the directory
+	// +optional
+	MountPath string `json:"mountPath,omitempty"`
+	// EnvFrom exposes every key as an environment variable
+	// +optional
+	EnvFrom bool `json:"envFrom,omitempty"`
+}
+
+// AppContainer is a container of the App Pods
+type AppContainer struct {
+	// Name of the container, unique within the Pod
+	Name string `json:"name"`
+	// Image of the container, the Defaulter appends the latest tag when it has none
+	Image string `json:"image"`
+	// Ports exposed by the container, names and numbers are unique within the Pod
+	// +optional
+	Ports []corev1.ContainerPort `json:"ports,omitempty"`
+	// Env sets environment variables in the container
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// Resources are the compute resources of the container
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+}
+
+// AppSchedule is a scaling window opened by each activation of its cron expression
+type AppSchedule struct {
+	// Schedule is a cron expression in the standard five field format, e.g. "0 20 * * 1-5"
+	Schedule string `json:"schedule"`
+	// Replicas of the Deployment while the window is active
+	// +kubebuilder:validation:Minimum=0
+	Replicas int32 `json:"replicas"`
+	// TimeZone is the IANA time zone Schedule is evaluated in, defaults to UTC
+	// +optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// AppScheduledAction is the next change of replicas planned by spec.schedules
+type AppScheduledAction struct {
+	// Time the next window opens at
+	Time metav1.Time `json:"time"`
+	// Replicas of the Deployment in the next window
+	Replicas int32 `json:"replicas"`
+}
+
+// AppNetworkPolicy lists the sources allowed to connect to the App Pods, an empty
+// policy denies all incoming traffic
+type AppNetworkPolicy struct {
+	// IngressControllerNamespace allows the Pods of the namespace running the ingress controller
+	// +optional
+	IngressControllerNamespace string `json:"ingressControllerNamespace,omitempty"`
+	// FromApps allows the Pods of these Apps in the same namespace
+	// +optional
+	FromApps []string `json:"fromApps,omitempty"`
+	// FromCIDRs allows these IP blocks
+	// +optional
+	FromCIDRs []string `json:"fromCIDRs,omitempty"`
+}
+
+// AppServiceAccount configures the ServiceAccount named after the App
+type AppServiceAccount struct {
+	// Rules are granted to the ServiceAccount through a Role and RoleBinding named after the App,
+	// limited to the verbs and resources allowed by the manager config
+	// +optional
+	Rules []rbacv1.PolicyRule `json:"rules,omitempty"`
+}
+
+// AppIngress configures the Ingress of an App
+type AppIngress struct {
+	// Host defaults to <name>.<domain>, the domain is ingressDomain of the ProjectConfig, mj.learn
+	// unless set
+	// +optional
+	Host string `json:"host,omitempty"`
+	// ClassName is the IngressClass handling the Ingress, defaults to ingressClassName of the
+	// ProjectConfig, nginx unless set
+	// +optional
+	ClassName string `json:"className,omitempty"`
+	// TLS terminates TLS for Host with the certificate of a Secret
+	// +optional
+	TLS *AppIngressTLS `json:"tls,omitempty"`
+	// Annotations are copied onto the Ingress
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Group names an IngressGroup merging the App into a shared Ingress, ClassName,
+	// TLS and Annotations are then taken from the group
+	// +optional
+	Group string `json:"group,omitempty"`
+}
+
+// AppIngressTLS references the Secret holding the TLS certificate of an Ingress
+type AppIngressTLS struct {
+	SecretName string `json:"secretName"`
+}
+
+// Condition types reported in AppStatus.Conditions
+const (
+	// ConditionAvailable is true when the Deployment has all desired replicas ready.
+	ConditionAvailable = "Available"
+	// ConditionReconciled is true when the last reconcile of the child objects succeeded.
+	ConditionReconciled = "Reconciled"
+	// ConditionTemplateError is true when a child object template failed to render for the App.
+	ConditionTemplateError = "TemplateError"
+	// ConditionSuspended is true while spec.suspended keeps the App scaled to zero.
+	ConditionSuspended = "Suspended"
+)
+
 type AppStatus struct {
 	DeploymentName string `json:"deployment_name"`
 	// +kubebuilder:default:service_name=""
 	ServiceName string `json:"service_name"`
 	// +kubebuilder:default:ingress_name=""
 	IngressName string `json:"ingress_name"`
+	// +optional
+	NetworkPolicyName string `json:"network_policy_name,omitempty"`
+	// +optional
+	ServiceAccountName string `json:"service_account_name,omitempty"`
+	// SuspendedReplicas is the number of replicas the Deployment had before the App was suspended
+	// +optional
+	SuspendedReplicas int32 `json:"suspended_replicas,omitempty"`
+	// NextSchedule is the next window of spec.schedules
+	// +optional
+	NextSchedule *AppScheduledAction `json:"next_schedule,omitempty"`
+	// ReadyReplicas is the number of ready pods of the Deployment
+	// +optional
+	ReadyReplicas int32 `json:"ready_replicas,omitempty"`
+	// ObservedGeneration is the App generation the status was computed from
+	// +optional
+	ObservedGeneration int64 `json:"observed_generation,omitempty"`
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
 
-// +kubebuilder:printcolumn:name:"deployment",type:string,JSONPath=`.status.deployment_name`
-// +kubebuilder:printcolumn:name:"service",type:string,JSONPath=`.status.service_name`
-// +kubebuilder:printcolumn:name:"ingress",type:string,JSONPath=`.status.ingress_name`
+// +kubebuilder:printcolumn:name="deployment",type=string,JSONPath=`.status.deployment_name`
+// +kubebuilder:printcolumn:name="service",type=string,JSONPath=`.status.service_name`
+// +kubebuilder:printcolumn:name="ingress",type=string,JSONPath=`.status.ingress_name`
+// +kubebuilder:printcolumn:name="ready",type=integer,JSONPath=`.status.ready_replicas`
+// +kubebuilder:printcolumn:name="suspended",type=boolean,JSONPath=`.spec.suspended`
+// +kubebuilder:printcolumn:name="age",type=date,JSONPath=`.metadata.creationTimestamp`
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 
@@ -35,6 +225,42 @@ type App struct {
 	Status AppStatus `json:"status,omitempty"`
 }
 
+// IngressHost returns spec.ingress.host, defaulting to <name>.<DefaultIngressDomain>
+func (r *App) IngressHost() string {
+	if r.Spec.Ingress.Host != "" {
+		return r.Spec.Ingress.Host
+	}
+	return r.Name + "." + DefaultIngressDomain
+}
+
+// AppContainers returns spec.containers, or the container described by the spec.image shorthand
+// when there are none.
+func (r *App) AppContainers() []AppContainer {
+	if len(r.Spec.Containers) > 0 || r.Spec.Image == "" {
+		return r.Spec.Containers
+	}
+	targetPort := r.Spec.TargetPort
+	if targetPort == 0 {
+		targetPort = r.Spec.Port
+	}
+	if targetPort == 0 {
+		targetPort = DefaultPort
+	}
+	return []AppContainer{{
+		Name:  r.Name,
+		Image: r.Spec.Image,
+		Ports: []corev1.ContainerPort{{ContainerPort: targetPort}},
+	}}
+}
+
+// IngressClassName returns spec.ingress.className, defaulting to DefaultIngressClassName
+func (r *App) IngressClassName() string {
+	if r.Spec.Ingress.ClassName != "" {
+		return r.Spec.Ingress.ClassName
+	}
+	return DefaultIngressClassName
+}
+
 // +kubebuilder:object:root=true
 
 // AppList contains a list of App
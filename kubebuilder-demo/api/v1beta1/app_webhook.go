@@ -17,9 +17,24 @@ limitations under the License.
 package v1beta1
 
 import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
@@ -40,15 +55,69 @@ func (r *App) SetupWebhookWithManager(mgr ctrl.Manager) error {
 
 var _ webhook.Defaulter = &App{}
 
+// DefaultImageTag is appended to images referenced without a tag or digest
+const DefaultImageTag = "latest"
+
+// DefaultPort is the Service port of Apps without spec.port
+const DefaultPort = 80
+
+// Defaults applied to the Ingress of an App, the manager may override them at startup
+var (
+	DefaultIngressDomain    = "mj.learn"
+	DefaultIngressClassName = "nginx"
+)
+
+// MaxReplicas bounds spec.replicas, the manager may override it at startup
+var MaxReplicas int32 = 50
+
+// Allowlists of the verbs and resources spec.serviceAccount.rules may grant, the manager may
+// override them at startup. Resources of other API groups are written <resource>.<group>,
+// subresources <resource>[.<group>]/<subresource>, "*" allows everything.
+var (
+	AllowedRoleVerbs     = []string{"get", "list", "watch"}
+	AllowedRoleResources = []string{"configmaps", "endpoints", "pods", "services"}
+)
+
+// Annotations guarding the deletion of an App. DeletionProtectionAnnotation set to "true"
+// rejects every delete until it is removed. While ProtectServingApps is enabled, Apps whose
+// Ingress routes to ready replicas can only be deleted with ForceDeleteAnnotation set to "true".
+const (
+	DeletionProtectionAnnotation = "ingress.mj.learn/deletion-protection"
+	ForceDeleteAnnotation        = "ingress.mj.learn/force-delete"
+)
+
+// ProtectServingApps rejects deleting Apps with live traffic, the manager may enable it at startup
+var ProtectServingApps = false
+
 // Default implements webhook.Defaulter so a webhook will be registered for the type
 func (r *App) Default() {
 	applog.Info("default", "name", r.Name)
 
-	r.Spec.EnableIngress = !r.Spec.EnableIngress
+	if r.Spec.Replicas == nil {
+		r.Spec.Replicas = pointer.Int32(1)
+	}
+	if r.Spec.Image != "" && !hasTagOrDigest(r.Spec.Image) {
+		r.Spec.Image = r.Spec.Image + ":" + DefaultImageTag
+	}
+	if r.Spec.Port == 0 {
+		r.Spec.Port = DefaultPort
+	}
+	// image 是单容器的简写,由 AppContainers 在渲染时展开,不写入 spec.containers
+	for _, containers := range [][]AppContainer{r.Spec.Containers, r.Spec.InitContainers} {
+		for i := range containers {
+			if !hasTagOrDigest(containers[i].Image) {
+				containers[i].Image = containers[i].Image + ":" + DefaultImageTag
+			}
+		}
+	}
+	// ingress 依赖 service
+	// targetPort、host 和 className 的默认值在渲染时解析,配置的默认值和 spec.port 修改后对已有的 App 同样生效
+	if r.Spec.EnableIngress {
+		r.Spec.EnableService = true
+	}
 }
 
-// TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
-// +kubebuilder:webhook:path=/validate-ingress-mj-learn-v1beta1-app,mutating=false,failurePolicy=fail,sideEffects=None,groups=ingress.mj.learn,resources=apps,verbs=create;update,versions=v1beta1,name=vapp.kb.io,admissionReviewVersions=v1
+// +kubebuilder:webhook:path=/validate-ingress-mj-learn-v1beta1-app,mutating=false,failurePolicy=fail,sideEffects=None,groups=ingress.mj.learn,resources=apps,verbs=create;update;delete,versions=v1beta1,name=vapp.kb.io,admissionReviewVersions=v1
 
 var _ webhook.Validator = &App{}
 
@@ -56,33 +125,358 @@ var _ webhook.Validator = &App{}
 func (r *App) ValidateCreate() error {
 	applog.Info("validate create", "name", r.Name)
 
-	return r.validateApp()
+	return recordAdmission("create", r.validateApp())
 }
 
 // ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
 func (r *App) ValidateUpdate(old runtime.Object) error {
 	applog.Info("validate update", "name", r.Name)
 
-	return r.validateApp()
+	if _, ok := old.(*App); !ok {
+		return recordAdmission("update", errors.NewBadRequest(fmt.Sprintf("expected an App but got a %T", old)))
+	}
+	// 关闭 enable_service 而保留 enable_ingress 的更新由 validateApp 拒绝,同时关闭时 controller 会一并删除 Ingress
+	return recordAdmission("update", r.validateApp())
 }
 
 // ValidateDelete implements webhook.Validator so a webhook will be registered for the type
 func (r *App) ValidateDelete() error {
 	applog.Info("validate delete", "name", r.Name)
 
-	// TODO(user): fill in your validation logic upon object deletion.
-	return nil
+	forbidden := func(format string, args ...interface{}) error {
+		return recordAdmission("delete", errors.NewForbidden(GroupVersion.WithResource("apps").GroupResource(), r.Name,
+			fmt.Errorf(format, args...)))
+	}
+	if r.Annotations[DeletionProtectionAnnotation] == "true" {
+		return forbidden("deletion protection is enabled, remove the %s annotation first", DeletionProtectionAnnotation)
+	}
+	// ready_replicas 由 controller 从 Deployment 同步
+	if ProtectServingApps && r.Annotations[ForceDeleteAnnotation] != "true" &&
+		r.Spec.EnableIngress && r.Status.IngressName != "" && r.Status.ReadyReplicas > 0 {
+		return forbidden("ingress %s routes to %d ready replicas, set the %s annotation to \"true\" to delete anyway",
+			r.Status.IngressName, r.Status.ReadyReplicas, ForceDeleteAnnotation)
+	}
+	return recordAdmission("delete", nil)
 }
 
 func (r *App) validateApp() error {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
 	if !r.Spec.EnableService && r.Spec.EnableIngress {
-		return errors.NewInvalid(GroupVersion.WithKind("App").GroupKind(), r.Name,
-			field.ErrorList{
-				field.Invalid(field.NewPath("enable_service"),
-					r.Spec.EnableService,
-					"enable_service should be true when enable_ingress is true"),
-			},
-		)
-	}
-	return nil
+		allErrs = append(allErrs, field.Invalid(specPath.Child("enable_service"),
+			r.Spec.EnableService,
+			"enable_service should be true when enable_ingress is true"))
+	}
+	if r.Spec.Image != "" && !validImage(r.Spec.Image) {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("image"), r.Spec.Image, "invalid image reference"))
+	}
+	allErrs = append(allErrs, r.validateContainers(specPath)...)
+	if r.Spec.Replicas != nil && (*r.Spec.Replicas < 0 || *r.Spec.Replicas > MaxReplicas) {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("replicas"), *r.Spec.Replicas,
+			fmt.Sprintf("must be between 0 and %d", MaxReplicas)))
+	}
+	for _, port := range []struct {
+		name  string
+		value int32
+	}{{"port", r.Spec.Port}, {"targetPort", r.Spec.TargetPort}} {
+		// 0 表示使用默认值
+		if port.value == 0 {
+			continue
+		}
+		for _, msg := range validation.IsValidPortNum(int(port.value)) {
+			allErrs = append(allErrs, field.Invalid(specPath.Child(port.name), port.value, msg))
+		}
+	}
+	allErrs = append(allErrs, validateIngress(&r.Spec.Ingress, specPath.Child("ingress"))...)
+	if r.Spec.NetworkPolicy != nil {
+		allErrs = append(allErrs, validateNetworkPolicy(r.Spec.NetworkPolicy, specPath.Child("networkPolicy"))...)
+	}
+	allErrs = append(allErrs, validateSchedules(r.Spec.Schedules, specPath.Child("schedules"))...)
+	if r.Spec.ServiceAccount != nil {
+		allErrs = append(allErrs, validateRoleRules(r.Spec.ServiceAccount.Rules, specPath.Child("serviceAccount", "rules"))...)
+	}
+	mountPaths := map[string]bool{}
+	allErrs = append(allErrs, validateConfigSources(r.Spec.ConfigMaps, mountPaths, specPath.Child("configMaps"))...)
+	allErrs = append(allErrs, validateConfigSources(r.Spec.Secrets, mountPaths, specPath.Child("secrets"))...)
+	// service 名称与 app 相同,需要满足 DNS-1035 label
+	for _, msg := range validation.IsDNS1035Label(r.Name) {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("metadata", "name"), r.Name, msg))
+	}
+
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("App").GroupKind(), r.Name, allErrs)
+}
+
+func validateIngress(ingress *AppIngress, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if ingress.Host != "" {
+		msgs := validation.IsDNS1123Subdomain(ingress.Host)
+		if strings.HasPrefix(ingress.Host, "*.") {
+			msgs = validation.IsWildcardDNS1123Subdomain(ingress.Host)
+		}
+		for _, msg := range msgs {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("host"), ingress.Host, msg))
+		}
+	}
+	if ingress.ClassName != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(ingress.ClassName) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("className"), ingress.ClassName, msg))
+		}
+	}
+	if ingress.TLS != nil {
+		for _, msg := range validation.IsDNS1123Subdomain(ingress.TLS.SecretName) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("tls", "secretName"), ingress.TLS.SecretName, msg))
+		}
+	}
+	if ingress.Group != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(ingress.Group) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("group"), ingress.Group, msg))
+		}
+	}
+	allErrs = append(allErrs, apivalidation.ValidateAnnotations(ingress.Annotations, fldPath.Child("annotations"))...)
+	return allErrs
+}
+
+// validateContainers checks that the containers and init containers have unique names and port
+// names, and that the containers do not expose the same port number twice.
+func (r *App) validateContainers(specPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	containers := r.AppContainers()
+	if len(containers) == 0 {
+		allErrs = append(allErrs, field.Required(specPath.Child("containers"), "set spec.image or spec.containers"))
+	}
+	if r.Spec.Image != "" && len(r.Spec.Containers) > 0 && r.Spec.Containers[0].Image != r.Spec.Image {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("image"), r.Spec.Image,
+			"must match spec.containers[0].image when both are set, remove spec.image to manage the containers only"))
+	}
+
+	names := map[string]bool{}
+	portNames := map[string]bool{}
+	portNumbers := map[corev1.ContainerPort]bool{}
+	for _, list := range []struct {
+		path       *field.Path
+		containers []AppContainer
+		// init 容器依次运行,端口不会冲突
+		sharePorts bool
+	}{{specPath.Child("containers"), containers, true}, {specPath.Child("initContainers"), r.Spec.InitContainers, false}} {
+		for i, c := range list.containers {
+			containerPath := list.path.Index(i)
+			for _, msg := range validation.IsDNS1123Label(c.Name) {
+				allErrs = append(allErrs, field.Invalid(containerPath.Child("name"), c.Name, msg))
+			}
+			if names[c.Name] {
+				allErrs = append(allErrs, field.Duplicate(containerPath.Child("name"), c.Name))
+			}
+			names[c.Name] = true
+			if !validImage(c.Image) {
+				allErrs = append(allErrs, field.Invalid(containerPath.Child("image"), c.Image, "invalid image reference"))
+			}
+
+			for j, port := range c.Ports {
+				portPath := containerPath.Child("ports").Index(j)
+				for _, msg := range validation.IsValidPortNum(int(port.ContainerPort)) {
+					allErrs = append(allErrs, field.Invalid(portPath.Child("containerPort"), port.ContainerPort, msg))
+				}
+				if port.Name != "" {
+					for _, msg := range validation.IsValidPortName(port.Name) {
+						allErrs = append(allErrs, field.Invalid(portPath.Child("name"), port.Name, msg))
+					}
+					if portNames[port.Name] {
+						allErrs = append(allErrs, field.Duplicate(portPath.Child("name"), port.Name))
+					}
+					portNames[port.Name] = true
+				}
+				if !list.sharePorts {
+					continue
+				}
+				// 同一个 Pod 中的容器共享网络
+				key := corev1.ContainerPort{ContainerPort: port.ContainerPort, Protocol: port.Protocol}
+				if key.Protocol == "" {
+					key.Protocol = corev1.ProtocolTCP
+				}
+				if portNumbers[key] {
+					allErrs = append(allErrs, field.Duplicate(portPath.Child("containerPort"), port.ContainerPort))
+				}
+				portNumbers[key] = true
+			}
+		}
+	}
+
+	if r.Spec.TargetPortName != "" && !portNames[r.Spec.TargetPortName] {
+		allErrs = append(allErrs, field.NotFound(specPath.Child("targetPortName"), r.Spec.TargetPortName))
+	}
+	return allErrs
+}
+
+func validImage(image string) bool {
+	return imageReferenceRegexp.MatchString(image) && len(image) <= maxImageLength
+}
+
+func validateSchedules(schedules []AppSchedule, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for i, schedule := range schedules {
+		schedulePath := fldPath.Index(i)
+		if _, err := cron.ParseStandard(schedule.Schedule); err != nil {
+			allErrs = append(allErrs, field.Invalid(schedulePath.Child("schedule"), schedule.Schedule, err.Error()))
+		}
+		if schedule.Replicas < 0 || schedule.Replicas > MaxReplicas {
+			allErrs = append(allErrs, field.Invalid(schedulePath.Child("replicas"), schedule.Replicas,
+				fmt.Sprintf("must be between 0 and %d", MaxReplicas)))
+		}
+		if _, err := time.LoadLocation(schedule.TimeZone); err != nil {
+			allErrs = append(allErrs, field.Invalid(schedulePath.Child("timeZone"), schedule.TimeZone, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+// ValidateRoleRules checks spec.serviceAccount.rules against AllowedRoleVerbs and AllowedRoleResources,
+// the reconciler calls it again since the allowlists may have changed after admission.
+func (r *App) ValidateRoleRules() error {
+	if r.Spec.ServiceAccount == nil {
+		return nil
+	}
+	allErrs := validateRoleRules(r.Spec.ServiceAccount.Rules, field.NewPath("spec", "serviceAccount", "rules"))
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return errors.NewInvalid(GroupVersion.WithKind("App").GroupKind(), r.Name, allErrs)
+}
+
+func validateRoleRules(rules []rbacv1.PolicyRule, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	verbs := sets.NewString(AllowedRoleVerbs...)
+	resources := sets.NewString(AllowedRoleResources...)
+	for i, rule := range rules {
+		rulePath := fldPath.Index(i)
+		if len(rule.NonResourceURLs) > 0 {
+			allErrs = append(allErrs, field.Forbidden(rulePath.Child("nonResourceURLs"), "a Role cannot grant non-resource URLs"))
+		}
+		if len(rule.Verbs) == 0 {
+			allErrs = append(allErrs, field.Required(rulePath.Child("verbs"), ""))
+		}
+		for j, verb := range rule.Verbs {
+			if !verbs.Has(verb) && !verbs.Has(rbacv1.VerbAll) {
+				allErrs = append(allErrs, field.NotSupported(rulePath.Child("verbs").Index(j), verb, verbs.List()))
+			}
+		}
+		if len(rule.APIGroups) == 0 {
+			allErrs = append(allErrs, field.Required(rulePath.Child("apiGroups"), `use "" for the core group`))
+		}
+		if len(rule.Resources) == 0 {
+			allErrs = append(allErrs, field.Required(rulePath.Child("resources"), ""))
+		}
+		for _, group := range rule.APIGroups {
+			for j, resource := range rule.Resources {
+				name := qualifiedResource(group, resource)
+				if !resources.Has(name) && !resources.Has(rbacv1.ResourceAll) {
+					allErrs = append(allErrs, field.Forbidden(rulePath.Child("resources").Index(j),
+						fmt.Sprintf("%s is not allowed, allowed resources: %s", name, strings.Join(resources.List(), ", "))))
+				}
+			}
+		}
+	}
+	return allErrs
+}
+
+// qualifiedResource returns resource of group in the <resource>.<group>/<subresource> form of AllowedRoleResources.
+func qualifiedResource(group, resource string) string {
+	name, subresource := resource, ""
+	if i := strings.Index(resource, "/"); i >= 0 {
+		name, subresource = resource[:i], resource[i:]
+	}
+	if group != "" {
+		name += "." + group
+	}
+	return name + subresource
+}
+
+func validateNetworkPolicy(policy *AppNetworkPolicy, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	if policy.IngressControllerNamespace != "" {
+		for _, msg := range validation.IsDNS1123Label(policy.IngressControllerNamespace) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("ingressControllerNamespace"), policy.IngressControllerNamespace, msg))
+		}
+	}
+	for i, app := range policy.FromApps {
+		for _, msg := range validation.IsDNS1035Label(app) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("fromApps").Index(i), app, msg))
+		}
+	}
+	for i, cidr := range policy.FromCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("fromCIDRs").Index(i), cidr, "must be a valid CIDR"))
+		}
+	}
+	return allErrs
+}
+
+// validateConfigSources checks the references of sources, recording their mount paths in
+// mountPaths so that ConfigMaps and Secrets cannot be mounted on the same directory.
+func validateConfigSources(sources []AppConfigSource, mountPaths map[string]bool, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	names := map[string]bool{}
+	for i, source := range sources {
+		idxPath := fldPath.Index(i)
+		for _, msg := range validation.IsDNS1123Subdomain(source.Name) {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("name"), source.Name, msg))
+		}
+		if names[source.Name] {
+			allErrs = append(allErrs, field.Duplicate(idxPath.Child("name"), source.Name))
+		}
+		names[source.Name] = true
+
+		switch {
+		case source.MountPath == "" && !source.EnvFrom:
+			allErrs = append(allErrs, field.Required(idxPath, "one of mountPath and envFrom must be set"))
+		case source.MountPath != "" && source.EnvFrom:
+			allErrs = append(allErrs, field.Invalid(idxPath, source.Name, "mountPath and envFrom are mutually exclusive"))
+		case source.MountPath != "":
+			switch {
+			case strings.IndexFunc(source.MountPath, unicode.IsControl) >= 0:
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("mountPath"), source.MountPath, "must not contain control characters"))
+			case !path.IsAbs(source.MountPath):
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("mountPath"), source.MountPath, "must be an absolute path"))
+			case path.Clean(source.MountPath) != source.MountPath:
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("mountPath"), source.MountPath,
+					"must be a clean path, without . or .. elements and repeated or trailing slashes"))
+			}
+			if mountPaths[path.Clean(source.MountPath)] {
+				allErrs = append(allErrs, field.Duplicate(idxPath.Child("mountPath"), source.MountPath))
+			}
+			mountPaths[path.Clean(source.MountPath)] = true
+		}
+	}
+	return allErrs
+}
+
+// maxImageLength bounds the length of an image reference
+const maxImageLength = 255
+
+// imageReferenceRegexp follows the grammar of github.com/distribution/reference:
+// [domain[:port]/]path[:tag][@digest]
+var imageReferenceRegexp = func() *regexp.Regexp {
+	const (
+		alphanumeric  = `[a-z0-9]+`
+		separator     = `(?:[._]|__|[-]+)`
+		pathComponent = alphanumeric + `(?:` + separator + alphanumeric + `)*`
+		domainLabel   = `(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])`
+		domain        = `(?:` + domainLabel + `(?:\.` + domainLabel + `)*|\[[a-fA-F0-9:]+\])(?::[0-9]+)?`
+		name          = `(?:` + domain + `/)?` + pathComponent + `(?:/` + pathComponent + `)*`
+		tag           = `[\w][\w.-]{0,127}`
+		digest        = `[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}`
+	)
+	return regexp.MustCompile(`^` + name + `(?::` + tag + `)?(?:@` + digest + `)?$`)
+}()
+
+// hasTagOrDigest reports whether image already pins a tag or digest.
+func hasTagOrDigest(image string) bool {
+	if strings.Contains(image, "@") {
+		return true
+	}
+	// 端口号只会出现在第一个 / 之前
+	return strings.Contains(image[strings.LastIndex(image, "/")+1:], ":")
 }
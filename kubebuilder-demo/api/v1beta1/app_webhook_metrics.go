@@ -0,0 +1,52 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// admissions counts the App validations by outcome, the reason of a rejection is the type of
+// its first cause, e.g. FieldValueInvalid, or the status reason when it has none. Both come
+// from fixed sets, field paths would give a label value per list index
+var admissions = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "app_webhook_admissions_total",
+	Help: "Number of App validations by operation, outcome and reason",
+}, []string{"operation", "allowed", "reason"})
+
+func init() {
+	metrics.Registry.MustRegister(admissions)
+}
+
+// recordAdmission counts the outcome of an operation validated with err and returns err.
+func recordAdmission(operation string, err error) error {
+	reason := ""
+	if err != nil {
+		reason = string(errors.ReasonForError(err))
+		if status, ok := err.(errors.APIStatus); ok {
+			if details := status.Status().Details; details != nil && len(details.Causes) > 0 {
+				reason = string(details.Causes[0].Type)
+			}
+		}
+	}
+	admissions.WithLabelValues(operation, strconv.FormatBool(err == nil), reason).Inc()
+	return err
+}
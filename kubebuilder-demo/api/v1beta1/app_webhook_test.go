@@ -0,0 +1,494 @@
+package v1beta1
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+func newTestApp(name string, spec AppSpec) *App {
+	return &App{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       spec,
+	}
+}
+
+func TestDefault(t *testing.T) {
+	tests := []struct {
+		name string
+		spec AppSpec
+		want AppSpec
+	}{
+		{
+			name: "replicas and tag",
+			spec: AppSpec{Image: "nginx"},
+			want: AppSpec{Image: "nginx:latest", Replicas: pointer.Int32(1), Port: 80},
+		},
+		{
+			name: "explicit zero replicas",
+			spec: AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(0)},
+			want: AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(0), Port: 80},
+		},
+		{
+			name: "registry port is not a tag",
+			spec: AppSpec{Image: "registry.local:5000/team/nginx", Replicas: pointer.Int32(3)},
+			want: AppSpec{Image: "registry.local:5000/team/nginx:latest", Replicas: pointer.Int32(3), Port: 80},
+		},
+		{
+			name: "digest is kept",
+			spec: AppSpec{Image: "nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", Replicas: pointer.Int32(1)},
+			want: AppSpec{
+				Image:    "nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+				Replicas: pointer.Int32(1), Port: 80,
+			},
+		},
+		{
+			name: "ingress enables service",
+			spec: AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(2), EnableIngress: true},
+			want: AppSpec{
+				Image: "nginx:1.23", Replicas: pointer.Int32(2), Port: 80, EnableService: true, EnableIngress: true,
+			},
+		},
+		{
+			name: "target port, host and class are resolved at render time",
+			spec: AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Port: 8080, EnableIngress: true, Ingress: AppIngress{Host: "demo.example.com", ClassName: "traefik"}},
+			want: AppSpec{
+				Image: "nginx:1.23", Replicas: pointer.Int32(1), Port: 8080, EnableService: true, EnableIngress: true,
+				Ingress: AppIngress{Host: "demo.example.com", ClassName: "traefik"},
+			},
+		},
+		{
+			name: "containers are tagged",
+			spec: AppSpec{
+				Containers:     []AppContainer{{Name: "web", Image: "nginx"}, {Name: "proxy", Image: "envoyproxy/envoy:v1.22.0"}},
+				InitContainers: []AppContainer{{Name: "migrate", Image: "migrate/migrate"}},
+			},
+			want: AppSpec{
+				Containers:     []AppContainer{{Name: "web", Image: "nginx:latest"}, {Name: "proxy", Image: "envoyproxy/envoy:v1.22.0"}},
+				InitContainers: []AppContainer{{Name: "migrate", Image: "migrate/migrate:latest"}},
+				Replicas:       pointer.Int32(1), Port: 80,
+			},
+		},
+		{
+			name: "image is tagged with the first container",
+			spec: AppSpec{Image: "nginx", Containers: []AppContainer{{Name: "web", Image: "nginx"}}},
+			want: AppSpec{
+				Image:      "nginx:latest",
+				Containers: []AppContainer{{Name: "web", Image: "nginx:latest"}},
+				Replicas:   pointer.Int32(1), Port: 80,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp("demo", tt.spec)
+			app.Default()
+			if !reflect.DeepEqual(app.Spec, tt.want) {
+				t.Errorf("expected %+v, got %+v", tt.want, app.Spec)
+			}
+			// 多次准入结果保持不变
+			app.Default()
+			if !reflect.DeepEqual(app.Spec, tt.want) {
+				t.Errorf("defaulting is not idempotent, got %+v", app.Spec)
+			}
+		})
+	}
+}
+
+func TestValidateApp(t *testing.T) {
+	tests := []struct {
+		name    string
+		app     *App
+		wantErr string
+	}{
+		{
+			name: "valid",
+			app:  newTestApp("demo", AppSpec{Image: "ghcr.io/team/demo:v1.0", Replicas: pointer.Int32(2), EnableService: true, EnableIngress: true}),
+		},
+		{
+			name:    "ingress without service",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), EnableIngress: true}),
+			wantErr: "spec.enable_service",
+		},
+		{
+			name:    "invalid image",
+			app:     newTestApp("demo", AppSpec{Image: "Nginx:1.23", Replicas: pointer.Int32(1)}),
+			wantErr: "spec.image",
+		},
+		{
+			name:    "image differs from the first container",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.24", Replicas: pointer.Int32(1), Containers: []AppContainer{{Name: "web", Image: "nginx:1.23"}}}),
+			wantErr: "spec.image",
+		},
+		{
+			name:    "no image or containers",
+			app:     newTestApp("demo", AppSpec{Replicas: pointer.Int32(1)}),
+			wantErr: "spec.containers",
+		},
+		{
+			name:    "too many replicas",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(MaxReplicas + 1)}),
+			wantErr: "spec.replicas",
+		},
+		{
+			name:    "negative replicas",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(-1)}),
+			wantErr: "spec.replicas",
+		},
+		{
+			name:    "invalid port",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Port: 70000}),
+			wantErr: "spec.port",
+		},
+		{
+			name:    "invalid target port",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), TargetPort: -1}),
+			wantErr: "spec.targetPort",
+		},
+		{
+			name: "ingress settings",
+			app: newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Ingress: AppIngress{
+				Host: "*.demo.example.com", ClassName: "nginx", TLS: &AppIngressTLS{SecretName: "demo-tls"},
+				Annotations: map[string]string{"nginx.ingress.kubernetes.io/ssl-redirect": "true"},
+			}}),
+		},
+		{
+			name:    "invalid ingress host",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Ingress: AppIngress{Host: "Demo_Host"}}),
+			wantErr: "spec.ingress.host",
+		},
+		{
+			name:    "invalid ingress class",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Ingress: AppIngress{ClassName: "Nginx!"}}),
+			wantErr: "spec.ingress.className",
+		},
+		{
+			name:    "missing tls secret",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Ingress: AppIngress{TLS: &AppIngressTLS{}}}),
+			wantErr: "spec.ingress.tls.secretName",
+		},
+		{
+			name:    "invalid ingress annotation",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Ingress: AppIngress{Annotations: map[string]string{"bad key": "v"}}}),
+			wantErr: "spec.ingress.annotations",
+		},
+		{
+			name: "config sources",
+			app: newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1),
+				ConfigMaps: []AppConfigSource{{Name: "config", MountPath: "/etc/config"}, {Name: "env", EnvFrom: true}},
+				Secrets:    []AppConfigSource{{Name: "config", MountPath: "/etc/secret"}},
+			}),
+		},
+		{
+			name:    "config source without mountPath or envFrom",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), ConfigMaps: []AppConfigSource{{Name: "config"}}}),
+			wantErr: "spec.configMaps[0]",
+		},
+		{
+			name:    "config source with mountPath and envFrom",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Secrets: []AppConfigSource{{Name: "config", MountPath: "/etc/config", EnvFrom: true}}}),
+			wantErr: "spec.secrets[0]",
+		},
+		{
+			name:    "relative mountPath",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), ConfigMaps: []AppConfigSource{{Name: "config", MountPath: "etc/config"}}}),
+			wantErr: "spec.configMaps[0].mountPath",
+		},
+		{
+			name: "duplicate mountPath",
+			app: newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1),
+				ConfigMaps: []AppConfigSource{{Name: "config", MountPath: "/etc/config"}},
+				Secrets:    []AppConfigSource{{Name: "secret", MountPath: "/etc/config"}},
+			}),
+			wantErr: "spec.secrets[0].mountPath",
+		},
+		{
+			name:    "mountPath that is not clean",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), ConfigMaps: []AppConfigSource{{Name: "config", MountPath: "/etc/../config/"}}}),
+			wantErr: "must be a clean path",
+		},
+		{
+			name: "multi-line mountPath",
+			app: newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1),
+				ConfigMaps: []AppConfigSource{{Name: "config", MountPath: "/etc/config\n          securityContext:\n            privileged: true"}},
+			}),
+			wantErr: "must not contain control characters",
+		},
+		{
+			name:    "duplicate name",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), ConfigMaps: []AppConfigSource{{Name: "config", EnvFrom: true}, {Name: "config", MountPath: "/etc/config"}}}),
+			wantErr: "spec.configMaps[1].name",
+		},
+		{
+			name: "network policy",
+			app: newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), NetworkPolicy: &AppNetworkPolicy{
+				IngressControllerNamespace: "ingress-nginx", FromApps: []string{"frontend"}, FromCIDRs: []string{"10.0.0.0/8"},
+			}}),
+		},
+		{
+			name:    "invalid network policy namespace",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), NetworkPolicy: &AppNetworkPolicy{IngressControllerNamespace: "Ingress_Nginx"}}),
+			wantErr: "spec.networkPolicy.ingressControllerNamespace",
+		},
+		{
+			name:    "invalid network policy app",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), NetworkPolicy: &AppNetworkPolicy{FromApps: []string{"1frontend"}}}),
+			wantErr: "spec.networkPolicy.fromApps[0]",
+		},
+		{
+			name:    "invalid network policy cidr",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), NetworkPolicy: &AppNetworkPolicy{FromCIDRs: []string{"10.0.0.0/8", "10.0.0.1"}}}),
+			wantErr: "spec.networkPolicy.fromCIDRs[1]",
+		},
+		{
+			name: "containers",
+			app: newTestApp("demo", AppSpec{Replicas: pointer.Int32(1), TargetPortName: "http",
+				Containers: []AppContainer{
+					{Name: "web", Image: "nginx:1.23", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+					{Name: "metrics", Image: "prom/statsd-exporter:v0.22.0", Ports: []corev1.ContainerPort{{Name: "metrics", ContainerPort: 9102}, {ContainerPort: 9125, Protocol: corev1.ProtocolUDP}}},
+				},
+				InitContainers: []AppContainer{{Name: "migrate", Image: "migrate/migrate:v4", Ports: []corev1.ContainerPort{{ContainerPort: 8080}}}},
+			}),
+		},
+		{
+			name:    "duplicate container name",
+			app:     newTestApp("demo", AppSpec{Replicas: pointer.Int32(1), Containers: []AppContainer{{Name: "web", Image: "nginx:1.23"}}, InitContainers: []AppContainer{{Name: "web", Image: "busybox:1.35"}}}),
+			wantErr: "spec.initContainers[0].name",
+		},
+		{
+			name:    "invalid container image",
+			app:     newTestApp("demo", AppSpec{Replicas: pointer.Int32(1), Containers: []AppContainer{{Name: "web", Image: "Nginx"}}}),
+			wantErr: "spec.containers[0].image",
+		},
+		{
+			name: "duplicate port number",
+			app: newTestApp("demo", AppSpec{Replicas: pointer.Int32(1), Containers: []AppContainer{
+				{Name: "web", Image: "nginx:1.23", Ports: []corev1.ContainerPort{{ContainerPort: 8080}}},
+				{Name: "proxy", Image: "envoyproxy/envoy:v1.22.0", Ports: []corev1.ContainerPort{{ContainerPort: 8080, Protocol: corev1.ProtocolTCP}}},
+			}}),
+			wantErr: "spec.containers[1].ports[0].containerPort",
+		},
+		{
+			name: "duplicate port name",
+			app: newTestApp("demo", AppSpec{Replicas: pointer.Int32(1), Containers: []AppContainer{
+				{Name: "web", Image: "nginx:1.23", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}},
+				{Name: "proxy", Image: "envoyproxy/envoy:v1.22.0", Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 9090}}},
+			}}),
+			wantErr: "spec.containers[1].ports[0].name",
+		},
+		{
+			name:    "unknown target port name",
+			app:     newTestApp("demo", AppSpec{Replicas: pointer.Int32(1), TargetPortName: "http", Containers: []AppContainer{{Name: "web", Image: "nginx:1.23"}}}),
+			wantErr: "spec.targetPortName",
+		},
+		{
+			name: "schedules",
+			app: newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Schedules: []AppSchedule{
+				{Schedule: "0 8 * * 1-5", Replicas: 3, TimeZone: "Asia/Shanghai"},
+				{Schedule: "0 20 * * 1-5", Replicas: 0},
+			}}),
+		},
+		{
+			name:    "invalid schedule",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Schedules: []AppSchedule{{Schedule: "0 25 * * *", Replicas: 1}}}),
+			wantErr: "spec.schedules[0].schedule",
+		},
+		{
+			name:    "too many scheduled replicas",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Schedules: []AppSchedule{{Schedule: "@daily", Replicas: 51}}}),
+			wantErr: "spec.schedules[0].replicas",
+		},
+		{
+			name:    "unknown time zone",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Schedules: []AppSchedule{{Schedule: "@daily", Replicas: 1, TimeZone: "Mars/Olympus"}}}),
+			wantErr: "spec.schedules[0].timeZone",
+		},
+		{
+			name: "service account rules",
+			app: newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), ServiceAccount: &AppServiceAccount{Rules: []rbacv1.PolicyRule{
+				{APIGroups: []string{""}, Resources: []string{"configmaps", "pods"}, Verbs: []string{"get", "list"}},
+			}}}),
+		},
+		{
+			name:    "service account verb not allowed",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), ServiceAccount: &AppServiceAccount{Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "delete"}}}}}),
+			wantErr: "spec.serviceAccount.rules[0].verbs[1]",
+		},
+		{
+			name:    "service account resource not allowed",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), ServiceAccount: &AppServiceAccount{Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods", "secrets"}, Verbs: []string{"get"}}}}}),
+			wantErr: "spec.serviceAccount.rules[0].resources[1]",
+		},
+		{
+			name:    "service account resource of another group",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), ServiceAccount: &AppServiceAccount{Rules: []rbacv1.PolicyRule{{APIGroups: []string{"apps"}, Resources: []string{"pods"}, Verbs: []string{"get"}}}}}),
+			wantErr: "pods.apps is not allowed",
+		},
+		{
+			name:    "service account wildcard verb",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), ServiceAccount: &AppServiceAccount{Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"*"}}}}}),
+			wantErr: "spec.serviceAccount.rules[0].verbs[0]",
+		},
+		{
+			name:    "service account non-resource url",
+			app:     newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), ServiceAccount: &AppServiceAccount{Rules: []rbacv1.PolicyRule{{NonResourceURLs: []string{"/healthz"}, Verbs: []string{"get"}}}}}),
+			wantErr: "spec.serviceAccount.rules[0].nonResourceURLs",
+		},
+		{
+			name:    "name starting with a digit",
+			app:     newTestApp("1demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1)}),
+			wantErr: "metadata.name",
+		},
+		{
+			name:    "name too long",
+			app:     newTestApp(strings.Repeat("a", 64), AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1)}),
+			wantErr: "metadata.name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.app.ValidateCreate()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestValidateUpdateDisableService(t *testing.T) {
+	old := newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), EnableService: true, EnableIngress: true})
+	old.Status.IngressName = "demo"
+
+	app := old.DeepCopy()
+	app.Spec.EnableService = false
+	if err := app.ValidateUpdate(old); err == nil || !strings.Contains(err.Error(), "spec.enable_service") {
+		t.Fatalf("expected disabling the service to be rejected, got %v", err)
+	}
+
+	// 同时关闭 ingress 时允许关闭 service,status 中的 ingress 由 controller 随后删除
+	app.Spec.EnableIngress = false
+	if err := app.ValidateUpdate(old); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateDelete(t *testing.T) {
+	serving := func(annotations map[string]string) *App {
+		app := newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(2), EnableService: true, EnableIngress: true})
+		app.Annotations = annotations
+		app.Status.IngressName = "demo"
+		app.Status.ReadyReplicas = 2
+		return app
+	}
+	stopped := serving(nil)
+	stopped.Status.ReadyReplicas = 0
+
+	tests := []struct {
+		name    string
+		app     *App
+		protect bool
+		wantErr string
+	}{
+		{
+			name: "unprotected",
+			app:  serving(nil),
+		},
+		{
+			name:    "deletion protection",
+			app:     serving(map[string]string{DeletionProtectionAnnotation: "true"}),
+			wantErr: DeletionProtectionAnnotation,
+		},
+		{
+			name:    "deletion protection wins over force",
+			app:     serving(map[string]string{DeletionProtectionAnnotation: "true", ForceDeleteAnnotation: "true"}),
+			protect: true,
+			wantErr: DeletionProtectionAnnotation,
+		},
+		{
+			name: "deletion protection disabled",
+			app:  serving(map[string]string{DeletionProtectionAnnotation: "false"}),
+		},
+		{
+			name:    "serving",
+			app:     serving(nil),
+			protect: true,
+			wantErr: "2 ready replicas",
+		},
+		{
+			name:    "serving forced",
+			app:     serving(map[string]string{ForceDeleteAnnotation: "true"}),
+			protect: true,
+		},
+		{
+			name:    "no ready replicas",
+			app:     stopped,
+			protect: true,
+		},
+	}
+
+	defer func(protect bool) { ProtectServingApps = protect }(ProtectServingApps)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ProtectServingApps = tt.protect
+			err := tt.app.ValidateDelete()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.IsForbidden(err) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("expected a forbidden error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestRecordAdmission(t *testing.T) {
+	valid := newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1)})
+	invalid := newTestApp("demo", AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(-1)})
+
+	before := testutil.ToFloat64(admissions.WithLabelValues("create", "true", ""))
+	if err := valid.ValidateCreate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := testutil.ToFloat64(admissions.WithLabelValues("create", "true", "")) - before; got != 1 {
+		t.Errorf("expected one allowed admission, got %v", got)
+	}
+
+	before = testutil.ToFloat64(admissions.WithLabelValues("update", "false", "FieldValueInvalid"))
+	if err := invalid.ValidateUpdate(valid); err == nil {
+		t.Fatal("expected error")
+	}
+	if got := testutil.ToFloat64(admissions.WithLabelValues("update", "false", "FieldValueInvalid")) - before; got != 1 {
+		t.Errorf("expected one rejection for an invalid value, got %v", got)
+	}
+}
+
+func TestQualifiedResource(t *testing.T) {
+	tests := []struct {
+		group, resource, want string
+	}{
+		{"", "pods", "pods"},
+		{"", "pods/log", "pods/log"},
+		{"apps", "deployments", "deployments.apps"},
+		{"apps", "deployments/scale", "deployments.apps/scale"},
+	}
+	for _, tt := range tests {
+		if got := qualifiedResource(tt.group, tt.resource); got != tt.want {
+			t.Errorf("qualifiedResource(%q, %q) = %q, want %q", tt.group, tt.resource, got, tt.want)
+		}
+	}
+}
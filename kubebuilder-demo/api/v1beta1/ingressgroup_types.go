@@ -0,0 +1,67 @@
+package v1beta1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// IngressGroupSpec configures the Ingress shared by the member Apps of an IngressGroup
+type IngressGroupSpec struct {
+	// ClassName is the IngressClass handling the shared Ingress, defaults to ingressClassName of
+	// the ProjectConfig, nginx unless set
+	// +optional
+	ClassName string `json:"className,omitempty"`
+	// TLS terminates TLS for the hosts of all member Apps with a shared certificate,
+	// the Secret must exist in every namespace with member Apps
+	// +optional
+	TLS *AppIngressTLS `json:"tls,omitempty"`
+	// Annotations are copied onto the shared Ingress
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// IngressGroupStatus reports the Ingresses merged from the member Apps
+type IngressGroupStatus struct {
+	// Members is the number of Apps routed through the group
+	// +optional
+	Members int32 `json:"members,omitempty"`
+	// Ingresses lists the merged Ingresses as namespace/name, one per namespace with member Apps
+	// +optional
+	Ingresses []string `json:"ingresses,omitempty"`
+	// Conflicts lists the member Apps left out of the merged Ingresses as namespace/name, their
+	// host is already routed by another member
+	// +optional
+	Conflicts []string `json:"conflicts,omitempty"`
+	// ObservedGeneration is the IngressGroup generation the status was computed from
+	// +optional
+	ObservedGeneration int64 `json:"observed_generation,omitempty"`
+}
+
+// +kubebuilder:printcolumn:name="class",type=string,JSONPath=`.spec.className`
+// +kubebuilder:printcolumn:name="members",type=integer,JSONPath=`.status.members`
+// +kubebuilder:printcolumn:name="age",type=date,JSONPath=`.metadata.creationTimestamp`
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+
+// IngressGroup is the Schema for the ingressgroups API, Apps referencing it through
+// spec.ingress.group share one Ingress per namespace instead of getting their own
+type IngressGroup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IngressGroupSpec   `json:"spec,omitempty"`
+	Status IngressGroupStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// IngressGroupList contains a list of IngressGroup
+type IngressGroupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []IngressGroup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&IngressGroup{}, &IngressGroupList{})
+}
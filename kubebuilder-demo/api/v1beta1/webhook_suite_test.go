@@ -30,8 +30,11 @@ import (
 
 	admissionv1beta1 "k8s.io/api/admission/v1beta1"
 	//+kubebuilder:scaffold:imports
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/rest"
+	"k8s.io/utils/pointer"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
@@ -133,3 +136,92 @@ var _ = AfterSuite(func() {
 	err := testEnv.Stop()
 	Expect(err).NotTo(HaveOccurred())
 })
+
+var _ = Describe("App webhook", func() {
+	newApp := func(name string) *App {
+		return &App{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       AppSpec{Image: "nginx"},
+		}
+	}
+
+	AfterEach(func() {
+		Expect(k8sClient.DeleteAllOf(ctx, &App{}, client.InNamespace("default"))).To(Succeed())
+	})
+
+	It("defaults the App on create", func() {
+		app := newApp("defaulted")
+		app.Spec.EnableIngress = true
+		Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+		Expect(*app.Spec.Replicas).To(Equal(int32(1)))
+		Expect(app.Spec.Image).To(Equal("nginx:" + DefaultImageTag))
+		Expect(app.Spec.Port).To(Equal(int32(DefaultPort)))
+		Expect(app.Spec.TargetPort).To(BeZero())
+		Expect(app.Spec.EnableService).To(BeTrue())
+		Expect(app.Spec.Ingress.Host).To(BeEmpty())
+		Expect(app.IngressHost()).To(Equal("defaulted." + DefaultIngressDomain))
+		Expect(app.Spec.Ingress.ClassName).To(BeEmpty())
+		Expect(app.IngressClassName()).To(Equal(DefaultIngressClassName))
+		Expect(app.Spec.Containers).To(BeEmpty())
+
+		By("keeping enable_ingress across updates")
+		app.Spec.Replicas = pointer.Int32(2)
+		Expect(k8sClient.Update(ctx, app)).To(Succeed())
+		Expect(app.Spec.EnableIngress).To(BeTrue())
+
+		By("following spec.image in the rendered container")
+		app.Spec.Image = "nginx:1.24"
+		Expect(k8sClient.Update(ctx, app)).To(Succeed())
+		Expect(app.Spec.Containers).To(BeEmpty())
+		Expect(app.AppContainers()).To(ConsistOf(HaveField("Image", "nginx:1.24")))
+	})
+
+	It("rejects an invalid App", func() {
+		app := newApp("invalid")
+		app.Spec.Image = "Not A Valid/Image"
+		app.Spec.Replicas = pointer.Int32(MaxReplicas + 1)
+		app.Spec.Ingress.Host = "Bad_Host"
+
+		err := k8sClient.Create(ctx, app)
+		Expect(apierrors.IsInvalid(err) || apierrors.IsForbidden(err)).To(BeTrue(), "unexpected error %v", err)
+		Expect(err.Error()).To(And(
+			ContainSubstring("spec.image"),
+			ContainSubstring("spec.replicas"),
+			ContainSubstring("spec.ingress.host"),
+		))
+	})
+
+	It("rejects a name that is not a DNS-1035 label", func() {
+		err := k8sClient.Create(ctx, newApp("1-app"))
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("metadata.name"))
+	})
+
+	It("allows disabling the Service together with its Ingress", func() {
+		app := newApp("routed")
+		app.Spec.EnableIngress = true
+		Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+		app.Status.IngressName = app.Name
+		Expect(k8sClient.Status().Update(ctx, app)).To(Succeed())
+
+		app.Spec.EnableService = false
+		app.Spec.EnableIngress = false
+		Expect(k8sClient.Update(ctx, app)).To(Succeed())
+	})
+
+	It("rejects deleting an App with deletion protection", func() {
+		app := newApp("protected")
+		app.Annotations = map[string]string{DeletionProtectionAnnotation: "true"}
+		Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+		err := k8sClient.Delete(ctx, app)
+		Expect(apierrors.IsForbidden(err)).To(BeTrue(), "unexpected error %v", err)
+
+		By("allowing the delete once the annotation is removed")
+		delete(app.Annotations, DeletionProtectionAnnotation)
+		Expect(k8sClient.Update(ctx, app)).To(Succeed())
+		Expect(k8sClient.Delete(ctx, app)).To(Succeed())
+	})
+})
@@ -18,37 +18,86 @@ package controllers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"time"
 
 	"kubebuilder-demo/controllers/utils"
 
 	v1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/ratelimiter"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
 )
 
+const (
+	// templateRefField indexes Apps by the name of the ConfigMap in spec.templateRef
+	templateRefField = ".spec.templateRef.name"
+	// configMapsField indexes Apps by the names of the ConfigMaps in spec.configMaps
+	configMapsField = ".spec.configMaps.name"
+	// secretsField indexes Apps by the names of the Secrets in spec.secrets
+	secretsField = ".spec.secrets.name"
+	// configHashAnnotation on the Pod template changes with the referenced ConfigMaps and Secrets
+	configHashAnnotation = "ingress.mj.learn/config-hash"
+)
+
 // AppReconciler reconciles a App object
 type AppReconciler struct {
 	client.Client
 	Scheme   *runtime.Scheme
 	Recorder record.EventRecorder
+	// Templates renders the child objects, see utils.ParseTemplates
+	Templates *utils.Templates
+	// MaxConcurrentReconciles is the number of Apps reconciled in parallel, defaults to 1
+	MaxConcurrentReconciles int
+	// RateLimiter limits the requeues of failed Apps, see NewRateLimiter
+	RateLimiter ratelimiter.RateLimiter
+	// Clock evaluates spec.schedules, defaults to the real clock
+	Clock Clock
+	// APIReader reads the children missing from a cache built by NewCache with managedOnly,
+	// see manager.GetAPIReader. Without it creating an unlabelled child keeps failing
+	APIReader client.Reader
 }
 
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles,verbs=escalate;bind
 // +kubebuilder:rbac:groups=ingress.mj.learn,resources=apps,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=ingress.mj.learn,resources=apps/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=ingress.mj.learn,resources=apps/finalizers,verbs=update
+// +kubebuilder:rbac:groups=ingress.mj.learn,resources=ingressgroups,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -65,99 +114,564 @@ func (r *AppReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 	app := &ingressv1beta1.App{}
 	// 从缓存中获取 app
 	if err := r.Get(ctx, req.NamespacedName, app); err != nil {
+		if errors.IsNotFound(err) {
+			trackedApps.forget(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// 处理子资源,结果统一写入 status
+	err := r.reconcileChildren(ctx, app)
+	setTemplateCondition(app, err)
+	setReconciledCondition(app, err)
+	app.Status.ObservedGeneration = app.Generation
+	if utils.IsTemplateError(err) {
+		// 模板渲染失败重试无意义,记录事件后等待 App 变更
+		logger.Error(err, "render template failed")
+		r.Recorder.Event(app, corev1.EventTypeWarning, ingressv1beta1.ConditionTemplateError, err.Error())
+		err = nil
+	}
+
+	trackedApps.track(app)
+
+	if statusErr := r.updateStatus(ctx, app); statusErr != nil {
+		logger.Error(statusErr, "update app status failed")
+		if err == nil {
+			err = statusErr
+		}
+	}
+
+	result := ctrl.Result{}
+	if next := app.Status.NextSchedule; next != nil {
+		// 下一个窗口开始时重新计算副本数,窗口可能在处理期间已经开始
+		result.RequeueAfter = next.Time.Sub(r.now())
+		if result.RequeueAfter < minScheduleRequeue {
+			result.RequeueAfter = minScheduleRequeue
+		}
+	}
+	return result, err
+}
+
+// reconcileChildren creates, updates or deletes the ServiceAccount, Deployment, Service, Ingress and NetworkPolicy of app,
+// recording the observed child names and readiness in app.Status.
+func (r *AppReconciler) reconcileChildren(ctx context.Context, app *ingressv1beta1.App) error {
+	key := types.NamespacedName{Name: app.Name, Namespace: app.Namespace}
+
+	// 先计算副本数,模板渲染失败时 status 中的下一个窗口也不会过期
+	scheduled, next, err := scheduledReplicas(app, r.now())
+	if err != nil {
+		return err
+	}
+	app.Status.NextSchedule = next
+
+	// 先渲染全部模板,渲染失败时不修改任何子资源
+	templates, err := r.templatesFor(ctx, app)
+	if err != nil {
+		return err
+	}
+	deployment, err := templates.NewDeployment(app)
+	if err != nil {
+		return err
+	}
+	configHash, err := r.configHash(ctx, app)
+	if err != nil {
+		return err
+	}
+	if configHash != "" {
+		// 配置内容变化时修改 Pod 模板,触发滚动更新
+		metav1.SetMetaDataAnnotation(&deployment.Spec.Template.ObjectMeta, configHashAnnotation, configHash)
+	}
+	replicas := scheduled
+	if app.Spec.Suspended {
+		replicas = 0
+	}
+	deployment.Spec.Replicas = &replicas
+	service, err := templates.NewService(app)
+	if err != nil {
+		return err
+	}
+	ingress, err := templates.NewIngress(app)
+	if err != nil {
+		return err
+	}
+	networkPolicy, err := templates.NewNetworkPolicy(app)
+	if err != nil {
+		return err
+	}
+
+	// ServiceAccount 需要先于 Pod 创建
+	if err := r.reconcileServiceAccount(ctx, app); err != nil {
+		return err
+	}
+
 	// 根据 app 的配置进行处理
-	// 1. Deployment 的处理
-	deployment := utils.NewDeployment(app)
-	if err := controllerutil.SetControllerReference(app, deployment, r.Scheme); err != nil {
-		return ctrl.Result{}, err
-	}
-	// 查找同名 deployment
-	d := &v1.Deployment{}
-	if err := r.Get(ctx, req.NamespacedName, d); err != nil {
-		if errors.IsNotFound(err) {
-			if err := r.Create(ctx, deployment); err != nil {
-				r.Recorder.Event(app, "Error", "Create", "创建 Deployment 失败")
-				logger.Error(err, "create deploy failed")
-				return ctrl.Result{}, err
-			}
-			app.Status.DeploymentName = d.Name
-			r.Recorder.Event(app, corev1.EventTypeNormal, "Create", "创建 Deployment 成功")
+	// 1. Deployment 的处理, 只修改 operator 负责的字段
+	d := &v1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: deployment.Name, Namespace: deployment.Namespace}}
+	if err := r.createOrPatch(ctx, app, d, func() error {
+		recordSuspendedReplicas(app, d, scheduled)
+		return mutateDeployment(d, deployment)
+	}); err != nil {
+		return err
+	}
+	app.Status.DeploymentName = d.Name
+	app.Status.ReadyReplicas = d.Status.ReadyReplicas
+	setAvailableCondition(app, replicas)
+	setSuspendedCondition(app)
+
+	// 2. Service的处理
+	if app.Spec.EnableService {
+		s := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: service.Name, Namespace: service.Namespace}}
+		if err := r.createOrPatch(ctx, app, s, func() error {
+			return mutateService(s, service)
+		}); err != nil {
+			return err
 		}
+		app.Status.ServiceName = s.Name
 	} else {
-		if err := r.Update(ctx, deployment); err != nil {
-			r.Recorder.Event(app, "Error", "Update", "更新 Deployment 失败")
-			return ctrl.Result{}, err
+		if err := r.deleteChild(ctx, app, &corev1.Service{}, key); err != nil {
+			return err
 		}
-		r.Recorder.Event(app, corev1.EventTypeNormal, "Update", "更新 Deployment 成功")
+		app.Status.ServiceName = ""
 	}
 
-	// 2. Service的处理
-	service := utils.NewService(app)
-	if err := controllerutil.SetControllerReference(app, service, r.Scheme); err != nil {
-		return ctrl.Result{}, err
-	}
-	// 查找指定 service
-	s := &corev1.Service{}
-	if err := r.Get(ctx, types.NamespacedName{Name: app.Name, Namespace: app.Namespace}, s); err != nil {
-		if errors.IsNotFound(err) && app.Spec.EnableService {
-			if err := r.Create(ctx, service); err != nil {
-				logger.Error(err, "create service failed")
-				return ctrl.Result{}, err
+	// 3. Ingress 的处理,加入 IngressGroup 时由 IngressGroupReconciler 合并到共享的 Ingress,暂停时删除
+	if app.Spec.EnableIngress && app.Spec.Ingress.Group == "" && !app.Spec.Suspended {
+		i := &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: ingress.Name, Namespace: ingress.Namespace}}
+		if err := r.createOrPatch(ctx, app, i, func() error {
+			mutateIngress(i, ingress)
+			return nil
+		}); err != nil {
+			return err
+		}
+		app.Status.IngressName = i.Name
+	} else {
+		if err := r.deleteChild(ctx, app, &netv1.Ingress{}, key); err != nil {
+			return err
+		}
+		app.Status.IngressName = ""
+		if app.Spec.EnableIngress && !app.Spec.Suspended {
+			name, err := r.groupIngress(ctx, app)
+			if err != nil {
+				return err
 			}
-			app.Status.ServiceName = s.Name
+			app.Status.IngressName = name
 		}
-		if !errors.IsNotFound(err) && app.Spec.EnableService {
-			return ctrl.Result{}, err
+	}
+
+	// 4. NetworkPolicy 的处理,清空 spec.networkPolicy 时删除
+	if app.Spec.NetworkPolicy != nil {
+		np := &netv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: networkPolicy.Name, Namespace: networkPolicy.Namespace}}
+		if err := r.createOrPatch(ctx, app, np, func() error {
+			mutateNetworkPolicy(np, networkPolicy)
+			return nil
+		}); err != nil {
+			return err
 		}
+		app.Status.NetworkPolicyName = np.Name
 	} else {
-		if app.Spec.EnableService {
-			logger.Info("already existed, skip update service")
-		} else {
-			if err := r.Delete(ctx, s); err != nil {
-				return ctrl.Result{}, err
-			}
-			app.Status.ServiceName = ""
+		if err := r.deleteChild(ctx, app, &netv1.NetworkPolicy{}, key); err != nil {
+			return err
 		}
+		app.Status.NetworkPolicyName = ""
 	}
 
-	// 3. Ingress 的处理,ingress 配置可能为空
-	ingress := utils.NewIngress(app)
-	if err := controllerutil.SetControllerReference(app, ingress, r.Scheme); err != nil {
-		return ctrl.Result{}, err
+	return nil
+}
+
+func (r *AppReconciler) now() time.Time {
+	if r.Clock == nil {
+		return realClock{}.Now()
 	}
-	i := &netv1.Ingress{}
-	if err := r.Get(ctx, types.NamespacedName{Name: app.Name, Namespace: app.Namespace}, i); err != nil {
-		if errors.IsNotFound(err) && app.Spec.EnableIngress {
-			if err := r.Create(ctx, ingress); err != nil {
-				logger.Error(err, "create ingress failed")
-				return ctrl.Result{}, err
-			}
-			app.Status.IngressName = i.Name
+	return r.Clock.Now()
+}
+
+// deleteChild deletes the object named key when it is controlled by app.
+func (r *AppReconciler) deleteChild(ctx context.Context, app *ingressv1beta1.App, obj client.Object, key types.NamespacedName) error {
+	if err := r.Get(ctx, key, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(obj, app) {
+		return nil
+	}
+	if err := r.Delete(ctx, obj); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	r.recordResult(app, kindOf(obj), obj.GetName(), resultDeleted)
+	return nil
+}
+
+// createOrPatch creates or patches obj, a child of app, with mutate and records the result.
+func (r *AppReconciler) createOrPatch(ctx context.Context, app *ingressv1beta1.App, obj client.Object, mutate func() error) error {
+	f := func() error {
+		if err := mutate(); err != nil {
+			return err
+		}
+		setManagedBy(obj)
+		return controllerutil.SetControllerReference(app, obj, r.Scheme)
+	}
+	result, err := controllerutil.CreateOrPatch(ctx, r.Client, obj, f)
+	if errors.IsAlreadyExists(err) && r.APIReader != nil {
+		// 缓存只包含带 managed-by label 的子资源,旧版本创建的子资源不在缓存中,
+		// 直接读取后打上 label,之后由缓存接管
+		result, err = r.patchUncached(ctx, obj, f)
+	}
+	if err != nil {
+		r.Recorder.Eventf(app, corev1.EventTypeWarning, "SyncFailed", "同步 %s %s 失败: %s", kindOf(obj), obj.GetName(), err)
+		log.FromContext(ctx).Error(err, "sync child failed", "kind", kindOf(obj))
+		return err
+	}
+	r.recordResult(app, kindOf(obj), obj.GetName(), result)
+	return nil
+}
+
+// patchUncached patches obj with f like controllerutil.CreateOrPatch, reading it through
+// APIReader instead of the cache.
+func (r *AppReconciler) patchUncached(ctx context.Context, obj client.Object, f controllerutil.MutateFn) (controllerutil.OperationResult, error) {
+	key := client.ObjectKeyFromObject(obj)
+	// 创建前 f 已经修改过 obj,读取前先清空
+	v := reflect.ValueOf(obj).Elem()
+	v.Set(reflect.Zero(v.Type()))
+	if err := r.APIReader.Get(ctx, key, obj); err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+	before := obj.DeepCopyObject().(client.Object)
+	if err := f(); err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+	if equality.Semantic.DeepEqual(before, obj) {
+		return controllerutil.OperationResultNone, nil
+	}
+	if err := r.Patch(ctx, obj, client.MergeFrom(before)); err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+	return controllerutil.OperationResultUpdated, nil
+}
+
+// resultDeleted complements the controllerutil.OperationResult values for deleted children
+const resultDeleted controllerutil.OperationResult = "deleted"
+
+// resultReasons maps the result of a child operation to its event reason
+var resultReasons = map[controllerutil.OperationResult]string{
+	controllerutil.OperationResultCreated:           "Created",
+	controllerutil.OperationResultUpdated:           "Updated",
+	controllerutil.OperationResultUpdatedStatus:     "Updated",
+	controllerutil.OperationResultUpdatedStatusOnly: "Updated",
+	resultDeleted: "Deleted",
+}
+
+// recordResult emits an event for every child that was actually changed.
+func (r *AppReconciler) recordResult(app *ingressv1beta1.App, kind, name string, result controllerutil.OperationResult) {
+	recordChildOperation(kind, result)
+	reason, ok := resultReasons[result]
+	if !ok {
+		return
+	}
+	r.Recorder.Eventf(app, corev1.EventTypeNormal, reason, "%s %s %s", kind, name, result)
+}
+
+func kindOf(obj client.Object) string {
+	switch obj.(type) {
+	case *v1.Deployment:
+		return "Deployment"
+	case *corev1.Service:
+		return "Service"
+	case *netv1.Ingress:
+		return "Ingress"
+	case *netv1.NetworkPolicy:
+		return "NetworkPolicy"
+	case *corev1.ServiceAccount:
+		return "ServiceAccount"
+	case *rbacv1.Role:
+		return "Role"
+	case *rbacv1.RoleBinding:
+		return "RoleBinding"
+	}
+	return obj.GetObjectKind().GroupVersionKind().Kind
+}
+
+// templatesFor returns the built-in templates, overridden by the ConfigMap referenced in spec.templateRef.
+func (r *AppReconciler) templatesFor(ctx context.Context, app *ingressv1beta1.App) (*utils.Templates, error) {
+	if app.Spec.TemplateRef == nil {
+		return r.Templates, nil
+	}
+
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, types.NamespacedName{Name: app.Spec.TemplateRef.Name, Namespace: app.Namespace}, cm); err != nil {
+		if errors.IsNotFound(err) {
+			// 等待 ConfigMap 创建后由 watch 触发
+			return nil, &utils.TemplateError{Template: app.Spec.TemplateRef.Name, Err: err}
 		}
-		if !errors.IsNotFound(err) && app.Spec.EnableIngress {
-			return ctrl.Result{}, err
+		return nil, err
+	}
+	return r.Templates.WithOverrides(cm.Data)
+}
+
+// configHash hashes the content of the ConfigMaps and Secrets referenced by app, it is
+// empty when app references none. Missing objects are hashed by name only, so their
+// creation rolls the Pods as well.
+func (r *AppReconciler) configHash(ctx context.Context, app *ingressv1beta1.App) (string, error) {
+	if len(app.Spec.ConfigMaps) == 0 && len(app.Spec.Secrets) == 0 {
+		return "", nil
+	}
+
+	h := sha256.New()
+	for _, source := range app.Spec.ConfigMaps {
+		cm := &corev1.ConfigMap{}
+		if err := r.Get(ctx, types.NamespacedName{Name: source.Name, Namespace: app.Namespace}, cm); client.IgnoreNotFound(err) != nil {
+			return "", err
 		}
-	} else {
-		if app.Spec.EnableIngress {
-			logger.Info("skip update ingress")
+		fmt.Fprintf(h, "configmap/%s\n", source.Name)
+		hashData(h, cm.Data, cm.BinaryData)
+	}
+	for _, source := range app.Spec.Secrets {
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, types.NamespacedName{Name: source.Name, Namespace: app.Namespace}, secret); client.IgnoreNotFound(err) != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "secret/%s\n", source.Name)
+		hashData(h, nil, secret.Data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashData writes the keys and values of data and binaryData to w in key order.
+func hashData(w io.Writer, data map[string]string, binaryData map[string][]byte) {
+	keys := make([]string, 0, len(data)+len(binaryData))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	for k := range binaryData {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if v, ok := data[k]; ok {
+			fmt.Fprintf(w, "%s=%q\n", k, v)
 		} else {
-			if err := r.Delete(ctx, i); err != nil {
-				return ctrl.Result{}, err
+			fmt.Fprintf(w, "%s=%q\n", k, binaryData[k])
+		}
+	}
+}
+
+// appsForConfigMap maps a ConfigMap to the Apps referencing it in spec.templateRef or spec.configMaps.
+func (r *AppReconciler) appsForConfigMap(obj client.Object) []reconcile.Request {
+	return r.appsReferencing(obj, templateRefField, configMapsField)
+}
+
+// appsForSecret maps a Secret to the Apps referencing it in spec.secrets.
+func (r *AppReconciler) appsForSecret(obj client.Object) []reconcile.Request {
+	return r.appsReferencing(obj, secretsField)
+}
+
+// appsForGroup maps an IngressGroup to its member Apps in all namespaces.
+func (r *AppReconciler) appsForGroup(obj client.Object) []reconcile.Request {
+	return r.appsReferencing(obj, groupField)
+}
+
+// groupIngress returns the name of the shared Ingress routing app, empty when its IngressGroup
+// does not exist or left app out for a host conflict.
+func (r *AppReconciler) groupIngress(ctx context.Context, app *ingressv1beta1.App) (string, error) {
+	group := &ingressv1beta1.IngressGroup{}
+	if err := r.Get(ctx, client.ObjectKey{Name: app.Spec.Ingress.Group}, group); err != nil {
+		return "", client.IgnoreNotFound(err)
+	}
+	key := client.ObjectKeyFromObject(app).String()
+	for _, conflict := range group.Status.Conflicts {
+		if conflict == key {
+			return "", nil
+		}
+	}
+	return groupIngressName(group.Name), nil
+}
+
+// appsReferencing lists the Apps in the namespace of obj, all namespaces for a cluster-scoped obj,
+// whose index in any of fields contains its name.
+func (r *AppReconciler) appsReferencing(obj client.Object, fields ...string) []reconcile.Request {
+	seen := map[types.NamespacedName]bool{}
+	var requests []reconcile.Request
+	for _, f := range fields {
+		apps := &ingressv1beta1.AppList{}
+		if err := r.List(context.Background(), apps,
+			client.InNamespace(obj.GetNamespace()),
+			client.MatchingFields{f: obj.GetName()}); err != nil {
+			log.Log.Error(err, "list apps referencing object failed", "object", client.ObjectKeyFromObject(obj), "field", f)
+			continue
+		}
+		for _, app := range apps.Items {
+			key := client.ObjectKeyFromObject(&app)
+			if seen[key] {
+				continue
 			}
-			app.Status.IngressName = ""
+			seen[key] = true
+			requests = append(requests, reconcile.Request{NamespacedName: key})
 		}
 	}
+	return requests
+}
+
+// updateStatus writes app.Status through the status subresource, retrying on conflicts
+// against the latest version of the App.
+func (r *AppReconciler) updateStatus(ctx context.Context, app *ingressv1beta1.App) error {
+	status := app.Status.DeepCopy()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		latest := &ingressv1beta1.App{}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(app), latest); err != nil {
+			return err
+		}
+		if equality.Semantic.DeepEqual(latest.Status, *status) {
+			return nil
+		}
+		latest.Status = *status
+		return r.Status().Update(ctx, latest)
+	})
+}
+
+// setAvailableCondition compares the ready replicas to replicas, those of spec.replicas or of
+// the active schedule window.
+func setAvailableCondition(app *ingressv1beta1.App, replicas int32) {
+	condition := metav1.Condition{
+		Type:               ingressv1beta1.ConditionAvailable,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: app.Generation,
+		Reason:             "DeploymentAvailable",
+		Message:            fmt.Sprintf("%d/%d replicas ready", app.Status.ReadyReplicas, replicas),
+	}
+	switch {
+	case app.Spec.Suspended:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "Suspended"
+		condition.Message = "the App is scaled to zero"
+	case app.Status.ReadyReplicas < replicas:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "DeploymentUnavailable"
+	}
+	meta.SetStatusCondition(&app.Status.Conditions, condition)
+}
+
+// recordSuspendedReplicas keeps the replicas of the live Deployment d in app.Status before a
+// suspended App scales it to zero, a Deployment created suspended records the replicas it
+// would have been created with.
+func recordSuspendedReplicas(app *ingressv1beta1.App, d *v1.Deployment, replicas int32) {
+	switch {
+	case !app.Spec.Suspended:
+		app.Status.SuspendedReplicas = 0
+	case d.CreationTimestamp.IsZero():
+		app.Status.SuspendedReplicas = replicas
+	case d.Spec.Replicas != nil && *d.Spec.Replicas > 0:
+		app.Status.SuspendedReplicas = *d.Spec.Replicas
+	}
+}
+
+func setSuspendedCondition(app *ingressv1beta1.App) {
+	condition := metav1.Condition{
+		Type:               ingressv1beta1.ConditionSuspended,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: app.Generation,
+		Reason:             "Running",
+		Message:            "the App is not suspended",
+	}
+	if app.Spec.Suspended {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "Suspended"
+		condition.Message = fmt.Sprintf("scaled down from %d replicas, the Ingress is removed", app.Status.SuspendedReplicas)
+	}
+	meta.SetStatusCondition(&app.Status.Conditions, condition)
+}
 
-	return ctrl.Result{}, nil
+func setTemplateCondition(app *ingressv1beta1.App, err error) {
+	condition := metav1.Condition{
+		Type:               ingressv1beta1.ConditionTemplateError,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: app.Generation,
+		Reason:             "TemplatesRendered",
+		Message:            "all templates rendered",
+	}
+	if utils.IsTemplateError(err) {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "RenderFailed"
+		condition.Message = err.Error()
+	}
+	meta.SetStatusCondition(&app.Status.Conditions, condition)
+}
+
+func setReconciledCondition(app *ingressv1beta1.App, err error) {
+	condition := metav1.Condition{
+		Type:               ingressv1beta1.ConditionReconciled,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: app.Generation,
+		Reason:             "ReconcileSucceeded",
+		Message:            "deployment, service and ingress are up to date",
+	}
+	if err != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ReconcileFailed"
+		condition.Message = err.Error()
+	}
+	meta.SetStatusCondition(&app.Status.Conditions, condition)
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *AppReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// 按 templateRef 建立索引, ConfigMap 变更时重新处理引用它的 App
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &ingressv1beta1.App{}, templateRefField,
+		func(obj client.Object) []string {
+			app := obj.(*ingressv1beta1.App)
+			if app.Spec.TemplateRef == nil {
+				return nil
+			}
+			return []string{app.Spec.TemplateRef.Name}
+		}); err != nil {
+		return err
+	}
+	// 按 spec.ingress.group 建立索引,IngressGroup 变化时更新成员的 status,合并时列出组内的 App
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &ingressv1beta1.App{}, groupField,
+		func(obj client.Object) []string {
+			app := obj.(*ingressv1beta1.App)
+			if app.Spec.Ingress.Group == "" {
+				return nil
+			}
+			return []string{app.Spec.Ingress.Group}
+		}); err != nil {
+		return err
+	}
+	// 按引用的 ConfigMap 和 Secret 建立索引,内容变化时重新计算 hash
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &ingressv1beta1.App{}, configMapsField,
+		func(obj client.Object) []string {
+			return configSourceNames(obj.(*ingressv1beta1.App).Spec.ConfigMaps)
+		}); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &ingressv1beta1.App{}, secretsField,
+		func(obj client.Object) []string {
+			return configSourceNames(obj.(*ingressv1beta1.App).Spec.Secrets)
+		}); err != nil {
+		return err
+	}
+
+	// status 的更新不会修改 generation,避免每次写入 status 后重复处理
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&ingressv1beta1.App{}).
-		Owns(&v1.Deployment{}).Owns(&netv1.Ingress{}).Owns(&corev1.Service{}).
+		For(&ingressv1beta1.App{}, builder.WithPredicates(countSkipped("App", predicate.GenerationChangedPredicate{}))).
+		Owns(&v1.Deployment{}, builder.WithPredicates(countSkipped("Deployment", deploymentChanged))).
+		Owns(&netv1.Ingress{}, builder.WithPredicates(countSkipped("Ingress", ingressChanged))).
+		Owns(&corev1.Service{}, builder.WithPredicates(countSkipped("Service", serviceChanged))).
+		Owns(&netv1.NetworkPolicy{}, builder.WithPredicates(countSkipped("NetworkPolicy", networkPolicyChanged))).
+		Owns(&corev1.ServiceAccount{}, builder.WithPredicates(countSkipped("ServiceAccount", metadataChanged))).
+		Owns(&rbacv1.Role{}, builder.WithPredicates(countSkipped("Role", roleChanged))).
+		Owns(&rbacv1.RoleBinding{}, builder.WithPredicates(countSkipped("RoleBinding", roleBindingChanged))).
+		Watches(&source.Kind{Type: &corev1.ConfigMap{}}, handler.EnqueueRequestsFromMapFunc(r.appsForConfigMap)).
+		Watches(&source.Kind{Type: &corev1.Secret{}}, handler.EnqueueRequestsFromMapFunc(r.appsForSecret)).
+		Watches(&source.Kind{Type: &ingressv1beta1.IngressGroup{}}, handler.EnqueueRequestsFromMapFunc(r.appsForGroup)).
+		WithOptions(controller.Options{
+			MaxConcurrentReconciles: r.MaxConcurrentReconciles,
+			RateLimiter:             r.RateLimiter,
+		}).
 		Complete(r)
 }
+
+func configSourceNames(sources []ingressv1beta1.AppConfigSource) []string {
+	names := make([]string, 0, len(sources))
+	for _, source := range sources {
+		names = append(names, source.Name)
+	}
+	return names
+}
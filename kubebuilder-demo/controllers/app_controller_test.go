@@ -0,0 +1,504 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
+)
+
+var _ = Describe("App controller", func() {
+	const (
+		timeout  = 10 * time.Second
+		interval = 250 * time.Millisecond
+	)
+
+	var (
+		app *ingressv1beta1.App
+		key types.NamespacedName
+	)
+
+	// envtest 不运行 kube-controller-manager,子资源不会被垃圾回收,每个用例使用独立的命名空间
+	BeforeEach(func() {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "app-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+
+		key = types.NamespacedName{Name: "demo", Namespace: ns.Name}
+		app = &ingressv1beta1.App{
+			ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+			Spec: ingressv1beta1.AppSpec{
+				Image:    "nginx:1.23",
+				Replicas: pointer.Int32(2),
+				Port:     8080,
+			},
+		}
+	})
+
+	getApp := func() *ingressv1beta1.App {
+		latest := &ingressv1beta1.App{}
+		Expect(k8sClient.Get(ctx, key, latest)).To(Succeed())
+		return latest
+	}
+
+	updateSpec := func(mutate func(spec *ingressv1beta1.AppSpec)) {
+		Eventually(func() error {
+			latest := getApp()
+			mutate(&latest.Spec)
+			return k8sClient.Update(ctx, latest)
+		}, timeout, interval).Should(Succeed())
+	}
+
+	exists := func(obj client.Object) func() error {
+		return func() error {
+			return k8sClient.Get(ctx, key, obj)
+		}
+	}
+
+	isNotFound := func(obj client.Object) func() bool {
+		return func() bool {
+			return errors.IsNotFound(k8sClient.Get(ctx, key, obj))
+		}
+	}
+
+	expectOwnedByApp := func(obj client.Object) {
+		owner := metav1.GetControllerOf(obj)
+		Expect(owner).NotTo(BeNil())
+		Expect(owner.Kind).To(Equal("App"))
+		Expect(owner.Name).To(Equal(app.Name))
+		Expect(owner.UID).To(Equal(app.UID))
+		Expect(obj.GetLabels()).To(HaveKeyWithValue(ManagedByLabel, ManagedBy))
+	}
+
+	Context("when an App is created", func() {
+		It("creates only the Deployment by default", func() {
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+			d := &v1.Deployment{}
+			Eventually(exists(d), timeout, interval).Should(Succeed())
+			expectOwnedByApp(d)
+			Expect(*d.Spec.Replicas).To(Equal(int32(2)))
+			Expect(d.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.23"))
+			Expect(d.Spec.Template.Spec.Containers[0].Ports[0].ContainerPort).To(Equal(int32(8080)))
+
+			Consistently(isNotFound(&corev1.Service{}), time.Second, interval).Should(BeTrue())
+			Expect(isNotFound(&netv1.Ingress{})()).To(BeTrue())
+
+			Eventually(func() string {
+				return getApp().Status.DeploymentName
+			}, timeout, interval).Should(Equal(app.Name))
+			status := getApp().Status
+			Expect(status.ServiceName).To(BeEmpty())
+			Expect(status.IngressName).To(BeEmpty())
+			Expect(status.ObservedGeneration).To(Equal(getApp().Generation))
+			Expect(meta.IsStatusConditionTrue(status.Conditions, ingressv1beta1.ConditionReconciled)).To(BeTrue())
+			Expect(meta.IsStatusConditionFalse(status.Conditions, ingressv1beta1.ConditionTemplateError)).To(BeTrue())
+			// 没有 kube-controller-manager,pod 永远不会就绪
+			Expect(meta.IsStatusConditionFalse(status.Conditions, ingressv1beta1.ConditionAvailable)).To(BeTrue())
+		})
+
+		It("creates the Service and Ingress when enabled", func() {
+			app.Spec.EnableService = true
+			app.Spec.EnableIngress = true
+			app.Spec.Ingress = ingressv1beta1.AppIngress{
+				Host:      "demo.example.com",
+				ClassName: "traefik",
+				TLS:       &ingressv1beta1.AppIngressTLS{SecretName: "demo-tls"},
+			}
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+			s := &corev1.Service{}
+			Eventually(exists(s), timeout, interval).Should(Succeed())
+			expectOwnedByApp(s)
+			Expect(s.Spec.Ports[0].Port).To(Equal(int32(8080)))
+			Expect(s.Spec.Selector).To(HaveKeyWithValue("app", app.Name))
+
+			i := &netv1.Ingress{}
+			Eventually(exists(i), timeout, interval).Should(Succeed())
+			expectOwnedByApp(i)
+			Expect(i.Spec.Rules[0].Host).To(Equal("demo.example.com"))
+			Expect(*i.Spec.IngressClassName).To(Equal("traefik"))
+			Expect(i.Spec.TLS[0].SecretName).To(Equal("demo-tls"))
+
+			Eventually(func() ingressv1beta1.AppStatus {
+				return getApp().Status
+			}, timeout, interval).Should(And(
+				HaveField("DeploymentName", app.Name),
+				HaveField("ServiceName", app.Name),
+				HaveField("IngressName", app.Name),
+			))
+		})
+	})
+
+	Context("when an App is updated", func() {
+		It("follows EnableService and EnableIngress being toggled", func() {
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+			Eventually(exists(&v1.Deployment{}), timeout, interval).Should(Succeed())
+
+			By("enabling the Service and the Ingress")
+			updateSpec(func(spec *ingressv1beta1.AppSpec) {
+				spec.EnableService = true
+				spec.EnableIngress = true
+			})
+			Eventually(exists(&corev1.Service{}), timeout, interval).Should(Succeed())
+			Eventually(exists(&netv1.Ingress{}), timeout, interval).Should(Succeed())
+			Eventually(func() string {
+				return getApp().Status.IngressName
+			}, timeout, interval).Should(Equal(app.Name))
+
+			By("disabling the Ingress")
+			updateSpec(func(spec *ingressv1beta1.AppSpec) {
+				spec.EnableIngress = false
+			})
+			Eventually(isNotFound(&netv1.Ingress{}), timeout, interval).Should(BeTrue())
+			Eventually(func() string {
+				return getApp().Status.IngressName
+			}, timeout, interval).Should(BeEmpty())
+			Expect(exists(&corev1.Service{})()).To(Succeed())
+
+			By("disabling the Service")
+			updateSpec(func(spec *ingressv1beta1.AppSpec) {
+				spec.EnableService = false
+			})
+			Eventually(isNotFound(&corev1.Service{}), timeout, interval).Should(BeTrue())
+			Eventually(func() string {
+				return getApp().Status.ServiceName
+			}, timeout, interval).Should(BeEmpty())
+		})
+
+		It("updates the Deployment", func() {
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+			Eventually(exists(&v1.Deployment{}), timeout, interval).Should(Succeed())
+
+			updateSpec(func(spec *ingressv1beta1.AppSpec) {
+				spec.Image = "nginx:1.24"
+				spec.Replicas = pointer.Int32(3)
+			})
+			Eventually(func() string {
+				d := &v1.Deployment{}
+				if err := k8sClient.Get(ctx, key, d); err != nil || *d.Spec.Replicas != 3 {
+					return ""
+				}
+				return d.Spec.Template.Spec.Containers[0].Image
+			}, timeout, interval).Should(Equal("nginx:1.24"))
+		})
+
+		It("leaves children it does not control alone", func() {
+			s := &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+				Spec: corev1.ServiceSpec{
+					Ports: []corev1.ServicePort{{Port: 80}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, s)).To(Succeed())
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+			Eventually(func() string {
+				return getApp().Status.DeploymentName
+			}, timeout, interval).Should(Equal(app.Name))
+			Consistently(exists(&corev1.Service{}), time.Second, interval).Should(Succeed())
+		})
+	})
+
+	Context("when an App sets a NetworkPolicy", func() {
+		It("creates the NetworkPolicy and removes it when cleared", func() {
+			app.Spec.NetworkPolicy = &ingressv1beta1.AppNetworkPolicy{
+				IngressControllerNamespace: "ingress-nginx",
+				FromCIDRs:                  []string{"10.0.0.0/8"},
+			}
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+			np := &netv1.NetworkPolicy{}
+			Eventually(exists(np), timeout, interval).Should(Succeed())
+			expectOwnedByApp(np)
+			Expect(np.Spec.PodSelector.MatchLabels).To(HaveKeyWithValue("app", app.Name))
+			Expect(np.Spec.Ingress[0].From).To(HaveLen(2))
+			Eventually(func() string {
+				return getApp().Status.NetworkPolicyName
+			}, timeout, interval).Should(Equal(app.Name))
+
+			By("allowing another App")
+			updateSpec(func(spec *ingressv1beta1.AppSpec) {
+				spec.NetworkPolicy.FromApps = []string{"frontend"}
+			})
+			Eventually(func() int {
+				np := &netv1.NetworkPolicy{}
+				if err := k8sClient.Get(ctx, key, np); err != nil || len(np.Spec.Ingress) == 0 {
+					return 0
+				}
+				return len(np.Spec.Ingress[0].From)
+			}, timeout, interval).Should(Equal(3))
+
+			By("clearing the block")
+			updateSpec(func(spec *ingressv1beta1.AppSpec) {
+				spec.NetworkPolicy = nil
+			})
+			Eventually(isNotFound(&netv1.NetworkPolicy{}), timeout, interval).Should(BeTrue())
+			Eventually(func() string {
+				return getApp().Status.NetworkPolicyName
+			}, timeout, interval).Should(BeEmpty())
+		})
+	})
+
+	Context("when an App is suspended", func() {
+		It("scales to zero, removes the Ingress and restores both", func() {
+			app.Spec.EnableService = true
+			app.Spec.EnableIngress = true
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+			Eventually(exists(&netv1.Ingress{}), timeout, interval).Should(Succeed())
+
+			By("suspending the App")
+			updateSpec(func(spec *ingressv1beta1.AppSpec) {
+				spec.Suspended = true
+			})
+			Eventually(func() int32 {
+				d := &v1.Deployment{}
+				if err := k8sClient.Get(ctx, key, d); err != nil {
+					return -1
+				}
+				return *d.Spec.Replicas
+			}, timeout, interval).Should(BeZero())
+			Eventually(isNotFound(&netv1.Ingress{}), timeout, interval).Should(BeTrue())
+			Expect(exists(&corev1.Service{})()).To(Succeed())
+			Eventually(func() bool {
+				return meta.IsStatusConditionTrue(getApp().Status.Conditions, ingressv1beta1.ConditionSuspended)
+			}, timeout, interval).Should(BeTrue())
+			status := getApp().Status
+			Expect(status.SuspendedReplicas).To(Equal(int32(2)))
+			Expect(status.IngressName).To(BeEmpty())
+
+			By("resuming the App")
+			updateSpec(func(spec *ingressv1beta1.AppSpec) {
+				spec.Suspended = false
+			})
+			Eventually(exists(&netv1.Ingress{}), timeout, interval).Should(Succeed())
+			Eventually(func() int32 {
+				d := &v1.Deployment{}
+				if err := k8sClient.Get(ctx, key, d); err != nil {
+					return -1
+				}
+				return *d.Spec.Replicas
+			}, timeout, interval).Should(Equal(int32(2)))
+			Eventually(func() bool {
+				return meta.IsStatusConditionFalse(getApp().Status.Conditions, ingressv1beta1.ConditionSuspended)
+			}, timeout, interval).Should(BeTrue())
+			Expect(getApp().Status.SuspendedReplicas).To(BeZero())
+		})
+	})
+
+	Context("when an App sets a ServiceAccount", func() {
+		It("provisions the ServiceAccount, Role and RoleBinding", func() {
+			app.Spec.ServiceAccount = &ingressv1beta1.AppServiceAccount{
+				Rules: []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "watch"}}},
+			}
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+			sa := &corev1.ServiceAccount{}
+			Eventually(exists(sa), timeout, interval).Should(Succeed())
+			expectOwnedByApp(sa)
+			role := &rbacv1.Role{}
+			Eventually(exists(role), timeout, interval).Should(Succeed())
+			expectOwnedByApp(role)
+			Expect(role.Rules).To(Equal(app.Spec.ServiceAccount.Rules))
+			binding := &rbacv1.RoleBinding{}
+			Eventually(exists(binding), timeout, interval).Should(Succeed())
+			Expect(binding.Subjects).To(ConsistOf(HaveField("Name", app.Name)))
+			Expect(binding.RoleRef.Name).To(Equal(role.Name))
+
+			d := &v1.Deployment{}
+			Eventually(exists(d), timeout, interval).Should(Succeed())
+			Expect(d.Spec.Template.Spec.ServiceAccountName).To(Equal(sa.Name))
+			Eventually(func() string {
+				return getApp().Status.ServiceAccountName
+			}, timeout, interval).Should(Equal(sa.Name))
+
+			By("dropping the rules")
+			updateSpec(func(spec *ingressv1beta1.AppSpec) {
+				spec.ServiceAccount.Rules = nil
+			})
+			Eventually(isNotFound(&rbacv1.RoleBinding{}), timeout, interval).Should(BeTrue())
+			Eventually(isNotFound(&rbacv1.Role{}), timeout, interval).Should(BeTrue())
+			Expect(exists(&corev1.ServiceAccount{})()).To(Succeed())
+
+			By("clearing the block")
+			updateSpec(func(spec *ingressv1beta1.AppSpec) {
+				spec.ServiceAccount = nil
+			})
+			Eventually(isNotFound(&corev1.ServiceAccount{}), timeout, interval).Should(BeTrue())
+			Eventually(func() string {
+				d := &v1.Deployment{}
+				if err := k8sClient.Get(ctx, key, d); err != nil {
+					return err.Error()
+				}
+				return d.Spec.Template.Spec.ServiceAccountName
+			}, timeout, interval).Should(BeEmpty())
+		})
+	})
+
+	Context("when an App references ConfigMaps and Secrets", func() {
+		It("rolls the Pods when their content changes", func() {
+			cm := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "demo-config", Namespace: key.Namespace},
+				Data:       map[string]string{"app.conf": "v1"},
+			}
+			Expect(k8sClient.Create(ctx, cm)).To(Succeed())
+			app.Spec.ConfigMaps = []ingressv1beta1.AppConfigSource{{Name: cm.Name, MountPath: "/etc/demo"}}
+			app.Spec.Secrets = []ingressv1beta1.AppConfigSource{{Name: "demo-credentials", EnvFrom: true}}
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+			hash := func() string {
+				d := &v1.Deployment{}
+				if err := k8sClient.Get(ctx, key, d); err != nil {
+					return ""
+				}
+				return d.Spec.Template.Annotations[configHashAnnotation]
+			}
+			Eventually(hash, timeout, interval).ShouldNot(BeEmpty())
+			initial := hash()
+
+			By("updating the ConfigMap")
+			cm.Data["app.conf"] = "v2"
+			Expect(k8sClient.Update(ctx, cm)).To(Succeed())
+			Eventually(hash, timeout, interval).ShouldNot(Equal(initial))
+			updated := hash()
+
+			By("creating the missing Secret")
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "demo-credentials", Namespace: key.Namespace},
+				Data:       map[string][]byte{"PASSWORD": []byte("secret")},
+			}
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+			Eventually(hash, timeout, interval).ShouldNot(Equal(updated))
+		})
+	})
+
+	Context("when a template fails to render", func() {
+		It("reports the TemplateError condition", func() {
+			app.Spec.TemplateRef = &corev1.LocalObjectReference{Name: "demo-templates"}
+			Expect(k8sClient.Create(ctx, app)).To(Succeed())
+
+			Eventually(func() bool {
+				return meta.IsStatusConditionTrue(getApp().Status.Conditions, ingressv1beta1.ConditionTemplateError)
+			}, timeout, interval).Should(BeTrue())
+			Expect(isNotFound(&v1.Deployment{})()).To(BeTrue())
+
+			By("creating the referenced ConfigMap")
+			cm := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "demo-templates", Namespace: key.Namespace},
+			}
+			Expect(k8sClient.Create(ctx, cm)).To(Succeed())
+			Eventually(exists(&v1.Deployment{}), timeout, interval).Should(Succeed())
+			Eventually(func() bool {
+				return meta.IsStatusConditionFalse(getApp().Status.Conditions, ingressv1beta1.ConditionTemplateError)
+			}, timeout, interval).Should(BeTrue())
+		})
+	})
+})
+
+func TestRecordSuspendedReplicas(t *testing.T) {
+	replicas := func(n int32) *int32 { return &n }
+	live := &v1.Deployment{ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.Now()}}
+
+	tests := []struct {
+		name      string
+		suspended bool
+		status    int32
+		live      *v1.Deployment
+		want      int32
+	}{
+		{name: "running", status: 3, live: live, want: 0},
+		{name: "created suspended", suspended: true, live: &v1.Deployment{}, want: 2},
+		{name: "suspending", suspended: true, live: &v1.Deployment{ObjectMeta: live.ObjectMeta, Spec: v1.DeploymentSpec{Replicas: replicas(4)}}, want: 4},
+		{name: "already scaled down", suspended: true, status: 4, live: &v1.Deployment{ObjectMeta: live.ObjectMeta, Spec: v1.DeploymentSpec{Replicas: replicas(0)}}, want: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &ingressv1beta1.App{Spec: ingressv1beta1.AppSpec{Replicas: pointer.Int32(2), Suspended: tt.suspended}}
+			app.Status.SuspendedReplicas = tt.status
+			recordSuspendedReplicas(app, tt.live, *app.Spec.Replicas)
+			if app.Status.SuspendedReplicas != tt.want {
+				t.Errorf("expected %d suspended replicas, got %d", tt.want, app.Status.SuspendedReplicas)
+			}
+		})
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "default"},
+		Data:       map[string]string{"a": "1", "b": "2"},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "secret", Namespace: "default"},
+		Data:       map[string][]byte{"password": []byte("p")},
+	}
+	r := &AppReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(cm, secret).Build()}
+
+	app := &ingressv1beta1.App{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec: ingressv1beta1.AppSpec{
+			ConfigMaps: []ingressv1beta1.AppConfigSource{{Name: "config", MountPath: "/etc/config"}},
+			Secrets:    []ingressv1beta1.AppConfigSource{{Name: "secret", EnvFrom: true}, {Name: "missing", EnvFrom: true}},
+		},
+	}
+	hash := func() string {
+		h, err := r.configHash(context.Background(), app)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return h
+	}
+
+	first := hash()
+	if first == "" || hash() != first {
+		t.Fatalf("expected a stable hash, got %q", first)
+	}
+
+	cm.Data["b"] = "3"
+	if err := r.Update(context.Background(), cm); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if hash() == first {
+		t.Errorf("expected the hash to change with the ConfigMap content")
+	}
+
+	app.Spec.ConfigMaps, app.Spec.Secrets = nil, nil
+	if h := hash(); h != "" {
+		t.Errorf("expected no hash without config sources, got %q", h)
+	}
+}
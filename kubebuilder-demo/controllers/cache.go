@@ -0,0 +1,87 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ManagedByLabel marks the children created by the operator, see NewCache
+const (
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedBy      = "kubebuilder-demo"
+)
+
+// setManagedBy labels a child so that it stays visible to a cache built with managedOnly.
+func setManagedBy(obj client.Object) {
+	objLabels := obj.GetLabels()
+	if objLabels == nil {
+		objLabels = map[string]string{}
+	}
+	objLabels[ManagedByLabel] = ManagedBy
+	obj.SetLabels(objLabels)
+}
+
+// managedSelector matches the objects labelled by setManagedBy
+var managedSelector = labels.SelectorFromSet(labels.Set{ManagedByLabel: ManagedBy})
+
+// managedSelectors restricts the owned kinds to the objects labelled by setManagedBy.
+// ConfigMaps and Secrets are referenced by Apps, not owned, and carry no label: they stay
+// cached in full in every watched namespace, the whole cluster when NewCache gets none.
+func managedSelectors() cache.SelectorsByObject {
+	selector := cache.ObjectSelector{Label: managedSelector}
+	return cache.SelectorsByObject{
+		&v1.Deployment{}:         selector,
+		&corev1.Service{}:        selector,
+		&netv1.Ingress{}:         selector,
+		&netv1.NetworkPolicy{}:   selector,
+		&corev1.ServiceAccount{}: selector,
+		&rbacv1.Role{}:           selector,
+		&rbacv1.RoleBinding{}:    selector,
+	}
+}
+
+// NewCache builds the cache of the manager. It watches the given namespaces only, all
+// namespaces when empty, and with managedOnly caches only the owned objects labelled by the
+// operator. Unlabelled children, created by versions before the label, are then invisible to
+// the cache: creating them again fails, and AppReconciler reads them through its APIReader
+// and labels them instead. Until then an unlabelled child that is no longer wanted is not
+// deleted, it goes with its App.
+func NewCache(namespaces []string, managedOnly bool) cache.NewCacheFunc {
+	return func(config *rest.Config, opts cache.Options) (cache.Cache, error) {
+		if managedOnly {
+			opts.SelectorsByObject = managedSelectors()
+		}
+		switch len(namespaces) {
+		case 0:
+			return cache.New(config, opts)
+		case 1:
+			opts.Namespace = namespaces[0]
+			return cache.New(config, opts)
+		default:
+			// 每个命名空间一个 informer,另有一个全局 cache 用于集群范围的资源
+			return cache.MultiNamespacedCacheBuilder(namespaces)(config, opts)
+		}
+	}
+}
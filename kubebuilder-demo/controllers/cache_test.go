@@ -0,0 +1,295 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	goruntime "runtime"
+	"testing"
+
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
+)
+
+func TestSetManagedBy(t *testing.T) {
+	d := &v1.Deployment{}
+	setManagedBy(d)
+	if d.Labels[ManagedByLabel] != ManagedBy {
+		t.Errorf("expected the managed-by label, got %v", d.Labels)
+	}
+
+	d.Labels = map[string]string{"app": "demo", ManagedByLabel: "helm"}
+	setManagedBy(d)
+	if d.Labels["app"] != "demo" || d.Labels[ManagedByLabel] != ManagedBy {
+		t.Errorf("expected the other labels kept and managed-by overwritten, got %v", d.Labels)
+	}
+}
+
+func TestManagedSelectors(t *testing.T) {
+	selectors := managedSelectors()
+	for obj, selector := range selectors {
+		if !selector.Label.Matches(labels.Set{ManagedByLabel: ManagedBy, "app": "demo"}) {
+			t.Errorf("expected the %T selector to match managed objects", obj)
+		}
+		if selector.Label.Matches(labels.Set{"app": "demo"}) {
+			t.Errorf("expected the %T selector to skip unmanaged objects", obj)
+		}
+	}
+	for _, obj := range []interface{}{&corev1.ConfigMap{}, &corev1.Secret{}} {
+		for owned := range selectors {
+			if fmt.Sprintf("%T", owned) == fmt.Sprintf("%T", obj) {
+				t.Errorf("expected %T to stay fully cached", obj)
+			}
+		}
+	}
+}
+
+// newFakeDeployments returns total Deployments of a cluster, of which managed are children of Apps.
+func newFakeDeployments(total, managed int) []*v1.Deployment {
+	deployments := make([]*v1.Deployment, 0, total)
+	for i := 0; i < total; i++ {
+		name := fmt.Sprintf("deployment-%d", i)
+		objLabels := map[string]string{"app": name}
+		if i < managed {
+			objLabels[ManagedByLabel] = ManagedBy
+		}
+		replicas := int32(2)
+		deployments = append(deployments, &v1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   fmt.Sprintf("team-%d", i%20),
+				Labels:      objLabels,
+				Annotations: map[string]string{"deployment.kubernetes.io/revision": "3"},
+			},
+			Spec: v1.DeploymentSpec{
+				Replicas: &replicas,
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": name}},
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{
+							Name:  name,
+							Image: "ghcr.io/team/" + name + ":v1.0.0",
+							Ports: []corev1.ContainerPort{{ContainerPort: 8080, Protocol: corev1.ProtocolTCP}},
+							Env:   []corev1.EnvVar{{Name: "LOG_LEVEL", Value: "info"}},
+							Resources: corev1.ResourceRequirements{
+								Requests: corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse("100m"),
+									corev1.ResourceMemory: resource.MustParse("128Mi"),
+								},
+							},
+						}},
+					},
+				},
+			},
+			Status: v1.DeploymentStatus{Replicas: 2, ReadyReplicas: 2, AvailableReplicas: 2},
+		})
+	}
+	return deployments
+}
+
+// managedOnlyClient hides the objects without the managed-by label from Get, like a cache
+// built by NewCache with managedOnly, while writes still reach every object.
+type managedOnlyClient struct {
+	client.Client
+}
+
+func (c managedOnlyClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	found := obj.DeepCopyObject().(client.Object)
+	if err := c.Client.Get(ctx, key, found); err != nil {
+		return err
+	}
+	if found.GetLabels()[ManagedByLabel] != ManagedBy {
+		return apierrors.NewNotFound(schema.GroupResource{Resource: kindOf(obj)}, key.Name)
+	}
+	return c.Client.Get(ctx, key, obj)
+}
+
+func TestCreateOrPatchUnlabelled(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = ingressv1beta1.AddToScheme(scheme)
+
+	app := &ingressv1beta1.App{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", UID: "uid"}}
+	// 旧版本创建的 Service 没有 managed-by label
+	legacy := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default", Labels: map[string]string{"app": "demo"}},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(80)}}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(app, legacy).Build()
+	r := &AppReconciler{
+		Client:    managedOnlyClient{c},
+		Scheme:    scheme,
+		Recorder:  record.NewFakeRecorder(10),
+		APIReader: c,
+	}
+
+	desired := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(8080)}}},
+	}
+	s := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"}}
+	if err := r.createOrPatch(context.Background(), app, s, func() error {
+		return mutateService(s, desired)
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	latest := &corev1.Service{}
+	if err := c.Get(context.Background(), client.ObjectKeyFromObject(s), latest); err != nil {
+		t.Fatal(err)
+	}
+	if latest.Labels[ManagedByLabel] != ManagedBy || latest.Labels["app"] != "demo" {
+		t.Errorf("expected the managed-by label added, got %v", latest.Labels)
+	}
+	if !metav1.IsControlledBy(latest, app) {
+		t.Errorf("expected the App to control the Service")
+	}
+	if len(latest.Spec.Ports) != 1 || latest.Spec.Ports[0].TargetPort.IntVal != 8080 {
+		t.Errorf("expected the Service patched, got %+v", latest.Spec.Ports)
+	}
+
+	// 打上 label 后缓存可以看到,不再回退
+	r.APIReader = nil
+	if err := r.createOrPatch(context.Background(), app, s, func() error {
+		return mutateService(s, desired)
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// deploymentsServer is a fake API server listing deployments filtered by the labelSelector of
+// the request, as the API server does, and holding watches open without events.
+func deploymentsServer(deployments []*v1.Deployment) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if req.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-req.Context().Done()
+			return
+		}
+		selector, err := labels.Parse(req.URL.Query().Get("labelSelector"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		list := &v1.DeploymentList{
+			TypeMeta: metav1.TypeMeta{APIVersion: "apps/v1", Kind: "DeploymentList"},
+			ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+		}
+		for _, d := range deployments {
+			if selector.Matches(labels.Set(d.Labels)) {
+				list.Items = append(list.Items, *d)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(list)
+	}))
+}
+
+// BenchmarkCacheDeployments builds the cache of the manager with NewCache, with and without
+// managedOnly, against a fake API server holding a cluster of 5000 Deployments of which 500
+// belong to Apps:
+//
+//	go test ./controllers/ -run '^$' -bench BenchmarkCacheDeployments -benchmem
+//
+// The selector of managedOnly reaches the server as the labelSelector of the list and watch,
+// so the objects metric is the number of Deployments in the cache. retained-B is the heap
+// still in use once the cache has synced, and follows that number rather than the number of
+// Apps. B/op also counts the decoding of the list.
+// The selector trades this memory for a migration path: children without the label, created
+// by versions before it existed, are read without the cache and labelled, see NewCache.
+func BenchmarkCacheDeployments(b *testing.B) {
+	server := deploymentsServer(newFakeDeployments(5000, 500))
+	defer server.Close()
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		b.Fatal(err)
+	}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(v1.SchemeGroupVersion.WithKind("Deployment"), meta.RESTScopeNamespace)
+	config := &rest.Config{Host: server.URL}
+
+	for _, bm := range []struct {
+		name        string
+		managedOnly bool
+	}{
+		{name: "all"},
+		{name: "managed-only", managedOnly: true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			cached, retained := 0, uint64(0)
+			for n := 0; n < b.N; n++ {
+				var before, after goruntime.MemStats
+				goruntime.GC()
+				goruntime.ReadMemStats(&before)
+
+				c, err := NewCache(nil, bm.managedOnly)(config, cache.Options{Scheme: scheme, Mapper: mapper})
+				if err != nil {
+					b.Fatal(err)
+				}
+				ctx, cancel := context.WithCancel(context.Background())
+				if _, err := c.GetInformer(ctx, &v1.Deployment{}); err != nil {
+					b.Fatal(err)
+				}
+				go func() {
+					_ = c.Start(ctx)
+				}()
+				if !c.WaitForCacheSync(ctx) {
+					b.Fatal("cache did not sync")
+				}
+				list := &v1.DeploymentList{}
+				if err := c.List(ctx, list); err != nil {
+					b.Fatal(err)
+				}
+				cached = len(list.Items)
+				list = nil
+
+				goruntime.GC()
+				goruntime.ReadMemStats(&after)
+				retained = after.HeapAlloc - before.HeapAlloc
+				goruntime.KeepAlive(c)
+				cancel()
+				server.CloseClientConnections()
+			}
+			b.ReportMetric(float64(cached), "objects")
+			b.ReportMetric(float64(retained), "retained-B")
+		})
+	}
+}
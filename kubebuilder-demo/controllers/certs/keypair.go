@@ -0,0 +1,200 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+)
+
+// keyPair is a certificate with its private key, parsed and PEM encoded.
+type keyPair struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// parseKeyPair parses the first certificate of certPEM and the EC private key of keyPEM.
+func parseKeyPair(certPEM, keyPEM []byte) (*keyPair, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil || keyBlock.Type != "EC PRIVATE KEY" {
+		return nil, errors.New("no EC private key found")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{cert: cert, key: key, certPEM: certPEM, keyPEM: keyPEM}, nil
+}
+
+// newCA generates a self-signed CA. The previous CA, while not expired, stays in certPEM
+// after the new one, so that serving certificates it signed are trusted until every replica
+// has loaded a certificate signed by the new CA.
+func newCA(previous []byte, now time.Time) (*keyPair, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "kubebuilder-demo-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	ca, err := newKeyPair(template, nil)
+	if err != nil {
+		return nil, err
+	}
+	if old, err := parseCerts(previous); err == nil && len(old) > 0 && now.Before(old[0].NotAfter) {
+		ca.certPEM = append(ca.certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: old[0].Raw})...)
+	}
+	return ca, nil
+}
+
+// newServingCert generates a serving certificate for hosts, signed by ca.
+func newServingCert(ca *keyPair, hosts []string, now time.Time) (*keyPair, error) {
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: hosts[0]},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(certValidity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return newKeyPair(template, ca)
+}
+
+// newKeyPair generates a key and a certificate from template, self-signed when parent is nil.
+func newKeyPair(template *x509.Certificate, parent *keyPair) (*keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	parentCert, parentKey := template, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &keyPair{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// parseCerts parses every certificate of a PEM bundle.
+func parseCerts(bundle []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return certs, nil
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+}
+
+// validCA reports whether the Secret data holds a CA that does not expire within rotateBefore.
+func validCA(data map[string][]byte, now time.Time) bool {
+	ca, err := parseKeyPair(data[caCertKey], data[caKeyKey])
+	if err != nil {
+		return false
+	}
+	return ca.cert.IsCA && now.Add(rotateBefore).Before(ca.cert.NotAfter)
+}
+
+// validCert reports whether the Secret data holds a serving certificate signed by its CA,
+// matching its key, valid for every host and not expiring within rotateBefore.
+func validCert(data map[string][]byte, hosts []string, now time.Time) bool {
+	ca, err := parseKeyPair(data[caCertKey], data[caKeyKey])
+	if err != nil {
+		return false
+	}
+	if _, err := tls.X509KeyPair(data[tlsCertKey], data[tlsKeyKey]); err != nil {
+		return false
+	}
+	certs, err := parseCerts(data[tlsCertKey])
+	if err != nil || len(certs) == 0 {
+		return false
+	}
+
+	// 只信任当前 CA,旧 CA 签发的证书需要重新签发
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	opts := x509.VerifyOptions{
+		Roots:       roots,
+		CurrentTime: now.Add(rotateBefore),
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return false
+	}
+	for _, host := range hosts {
+		if certs[0].VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,301 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package certs provisions the webhook serving certificate without cert-manager.
+package certs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// Keys of the Secret, the same as those of a cert-manager Certificate
+	caCertKey  = "ca.crt"
+	caKeyKey   = "ca.key"
+	tlsCertKey = corev1.TLSCertKey
+	tlsKeyKey  = corev1.TLSPrivateKeyKey
+
+	// caValidity and certValidity are the lifetimes of newly generated certificates
+	caValidity   = 10 * 365 * 24 * time.Hour
+	certValidity = 365 * 24 * time.Hour
+	// rotateBefore renews the certificates this long before they expire
+	rotateBefore = 90 * 24 * time.Hour
+	// checkInterval is the period of the expiry checks, retryInterval the delay after a failed one
+	checkInterval = 12 * time.Hour
+	retryInterval = 10 * time.Second
+)
+
+// The rotator only touches the objects named in main.go. resourceNames cannot restrict create, and
+// kustomize does not prefix them, so the names below carry the namePrefix of config/default and
+// the Role is bound in its namespace. Deploying with another namePrefix or namespace requires
+// running the manager with the matching --name-prefix and updating these markers, otherwise the
+// rotator is denied access to the objects it injects the CA into.
+// +kubebuilder:rbac:groups="",namespace=system,resources=secrets,verbs=create
+// +kubebuilder:rbac:groups="",namespace=system,resources=secrets,verbs=get;update,resourceNames=webhook-server-cert
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;update,resourceNames=kubebuilder-demo-mutating-webhook-configuration
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=validatingwebhookconfigurations,verbs=get;update,resourceNames=kubebuilder-demo-validating-webhook-configuration
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;update,resourceNames=apps.ingress.mj.learn;ingressgroups.ingress.mj.learn
+
+// Rotator keeps a self-signed CA and a serving certificate for the webhook server in a Secret,
+// writes the serving certificate to CertDir and injects the CA into the webhook configurations
+// and the conversion webhooks of the CRDs. It runs on every replica, concurrent writes of the
+// Secret are resolved by its resourceVersion.
+type Rotator struct {
+	// Client writes the Secret and the objects the CA is injected into
+	Client client.Client
+	// Reader reads them without a cache, see manager.GetAPIReader
+	Reader client.Reader
+	// SecretKey names the Secret holding the CA and the serving certificate
+	SecretKey types.NamespacedName
+	// CertDir receives tls.crt and tls.key, see webhook.Server.CertDir
+	CertDir string
+	// Hosts are the DNS names and IP addresses the serving certificate is valid for
+	Hosts []string
+	// MutatingWebhooks, ValidatingWebhooks and CRDs name the objects the CA is injected into,
+	// missing ones are skipped
+	MutatingWebhooks   []string
+	ValidatingWebhooks []string
+	CRDs               []string
+
+	readyOnce sync.Once
+	ready     chan struct{}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every replica serves webhooks.
+func (r *Rotator) NeedLeaderElection() bool {
+	return false
+}
+
+// Ready is closed once the serving certificate has been written to CertDir.
+func (r *Rotator) Ready() <-chan struct{} {
+	r.readyOnce.Do(func() {
+		r.ready = make(chan struct{})
+	})
+	return r.ready
+}
+
+// ReadyzCheck fails until the serving certificate has been written to CertDir.
+func (r *Rotator) ReadyzCheck(_ *http.Request) error {
+	if !isClosed(r.Ready()) {
+		return errors.New("webhook certificate is not ready")
+	}
+	return nil
+}
+
+// Start implements manager.Runnable, checking the certificates until ctx is done.
+func (r *Rotator) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("cert-rotator")
+	ready := r.Ready()
+
+	for {
+		delay := checkInterval
+		if err := r.Sync(ctx); err != nil {
+			logger.Error(err, "sync webhook certificate failed")
+			delay = retryInterval
+		} else if !isClosed(ready) {
+			close(r.ready)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Sync renews the CA and the serving certificate stored in the Secret when they are missing,
+// invalid or about to expire, then writes the serving certificate to CertDir and injects the CA.
+func (r *Rotator) Sync(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("cert-rotator")
+	if len(r.Hosts) == 0 {
+		return errors.New("no hosts for the webhook certificate")
+	}
+	now := time.Now()
+
+	secret := &corev1.Secret{}
+	err := r.Reader.Get(ctx, r.SecretKey, secret)
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	exists := err == nil
+
+	data := secret.Data
+	if !validCA(data, now) || !validCert(data, r.Hosts, now) {
+		data, err = r.renew(data, now)
+		if err != nil {
+			return err
+		}
+		secret.Name, secret.Namespace = r.SecretKey.Name, r.SecretKey.Namespace
+		secret.Type = corev1.SecretTypeTLS
+		secret.Data = data
+		if exists {
+			err = r.Client.Update(ctx, secret)
+		} else {
+			err = r.Client.Create(ctx, secret)
+		}
+		if err != nil {
+			// 其他副本同时更新时,下次检查使用对方生成的证书
+			return fmt.Errorf("write secret %s: %w", r.SecretKey, err)
+		}
+		logger.Info("renewed webhook certificate", "secret", r.SecretKey)
+	}
+
+	// 先注入 CA 再加载新证书,避免 apiserver 还不信任新 CA 时就用它签发的证书提供服务
+	if err := r.injectCA(ctx, data[caCertKey]); err != nil {
+		return err
+	}
+	return r.writeCertDir(data)
+}
+
+// renew returns the Secret data with a new serving certificate, signed by a new CA as well
+// when the current one is no longer valid.
+func (r *Rotator) renew(data map[string][]byte, now time.Time) (map[string][]byte, error) {
+	var ca *keyPair
+	var err error
+	if validCA(data, now) {
+		ca, err = parseKeyPair(data[caCertKey], data[caKeyKey])
+	} else {
+		ca, err = newCA(data[caCertKey], now)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := newServingCert(ca, r.Hosts, now)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		caCertKey:  ca.certPEM,
+		caKeyKey:   ca.keyPEM,
+		tlsCertKey: cert.certPEM,
+		tlsKeyKey:  cert.keyPEM,
+	}, nil
+}
+
+// writeCertDir writes the serving certificate and key, only when changed so that the
+// certificate watcher of the webhook server does not reload for nothing.
+func (r *Rotator) writeCertDir(data map[string][]byte) error {
+	if err := os.MkdirAll(r.CertDir, 0700); err != nil {
+		return err
+	}
+	for _, key := range []string{tlsCertKey, tlsKeyKey} {
+		path := filepath.Join(r.CertDir, key)
+		if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data[key]) {
+			continue
+		}
+		if err := os.WriteFile(path, data[key], 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// injectCA sets caBundle on every webhook of the webhook configurations and on the conversion
+// webhook of the CRDs. caBundle is ca.crt of the Secret, which keeps the previous CA after a
+// rotation while it has not expired (see newCA). The other replicas load the new serving
+// certificate on their next check, up to checkInterval later, and the certificate they serve
+// until then is still trusted.
+func (r *Rotator) injectCA(ctx context.Context, caBundle []byte) error {
+	for _, name := range r.MutatingWebhooks {
+		if err := r.updateIfFound(ctx, name, &admissionregistrationv1.MutatingWebhookConfiguration{}, func(obj client.Object) bool {
+			config := obj.(*admissionregistrationv1.MutatingWebhookConfiguration)
+			changed := false
+			for i := range config.Webhooks {
+				changed = setCABundle(&config.Webhooks[i].ClientConfig.CABundle, caBundle) || changed
+			}
+			return changed
+		}); err != nil {
+			return err
+		}
+	}
+	for _, name := range r.ValidatingWebhooks {
+		if err := r.updateIfFound(ctx, name, &admissionregistrationv1.ValidatingWebhookConfiguration{}, func(obj client.Object) bool {
+			config := obj.(*admissionregistrationv1.ValidatingWebhookConfiguration)
+			changed := false
+			for i := range config.Webhooks {
+				changed = setCABundle(&config.Webhooks[i].ClientConfig.CABundle, caBundle) || changed
+			}
+			return changed
+		}); err != nil {
+			return err
+		}
+	}
+	for _, name := range r.CRDs {
+		if err := r.updateIfFound(ctx, name, &apiextensionsv1.CustomResourceDefinition{}, func(obj client.Object) bool {
+			crd := obj.(*apiextensionsv1.CustomResourceDefinition)
+			// 没有配置 conversion webhook 的 CRD 不需要 CA
+			conversion := crd.Spec.Conversion
+			if conversion == nil || conversion.Strategy != apiextensionsv1.WebhookConverter ||
+				conversion.Webhook == nil || conversion.Webhook.ClientConfig == nil {
+				return false
+			}
+			return setCABundle(&conversion.Webhook.ClientConfig.CABundle, caBundle)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateIfFound reads the object called name into obj and updates it when mutate changed it.
+func (r *Rotator) updateIfFound(ctx context.Context, name string, obj client.Object, mutate func(obj client.Object) bool) error {
+	if err := r.Reader.Get(ctx, types.NamespacedName{Name: name}, obj); err != nil {
+		if apierrors.IsNotFound(err) {
+			log.FromContext(ctx).WithName("cert-rotator").V(1).Info("skip injecting the CA into a missing object", "name", name)
+			return nil
+		}
+		return err
+	}
+	if !mutate(obj) {
+		return nil
+	}
+	return r.Client.Update(ctx, obj)
+}
+
+func setCABundle(current *[]byte, caBundle []byte) bool {
+	if bytes.Equal(*current, caBundle) {
+		return false
+	}
+	*current = caBundle
+	return true
+}
+
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
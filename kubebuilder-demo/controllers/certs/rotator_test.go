@@ -0,0 +1,246 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var testHosts = []string{"webhook-service.system.svc", "192.168.59.1"}
+
+func newTestRotator(t *testing.T, objs ...client.Object) *Rotator {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	if err := apiextensionsv1.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	return &Rotator{
+		Client:             c,
+		Reader:             c,
+		SecretKey:          types.NamespacedName{Namespace: "system", Name: "webhook-server-cert"},
+		CertDir:            t.TempDir(),
+		Hosts:              testHosts,
+		MutatingWebhooks:   []string{"mutating-webhook-configuration"},
+		ValidatingWebhooks: []string{"validating-webhook-configuration", "missing"},
+		CRDs:               []string{"apps.ingress.mj.learn", "ingressgroups.ingress.mj.learn"},
+	}
+}
+
+func secretData(t *testing.T, r *Rotator) map[string][]byte {
+	secret := &corev1.Secret{}
+	if err := r.Reader.Get(context.Background(), r.SecretKey, secret); err != nil {
+		t.Fatal(err)
+	}
+	return secret.Data
+}
+
+func TestSync(t *testing.T) {
+	mutating := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "mutating-webhook-configuration"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "mapp.kb.io"}},
+	}
+	validating := &admissionregistrationv1.ValidatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "validating-webhook-configuration"},
+		Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "vapp.kb.io"}, {Name: "vingressgroup.kb.io"}},
+	}
+	converted := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "apps.ingress.mj.learn"},
+		Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+			Conversion: &apiextensionsv1.CustomResourceConversion{
+				Strategy: apiextensionsv1.WebhookConverter,
+				Webhook: &apiextensionsv1.WebhookConversion{
+					ClientConfig: &apiextensionsv1.WebhookClientConfig{},
+				},
+			},
+		},
+	}
+	plain := &apiextensionsv1.CustomResourceDefinition{
+		ObjectMeta: metav1.ObjectMeta{Name: "ingressgroups.ingress.mj.learn"},
+	}
+	r := newTestRotator(t, mutating, validating, converted, plain)
+	ctx := context.Background()
+
+	if err := r.ReadyzCheck(nil); err == nil {
+		t.Errorf("expected readyz to fail before the first sync")
+	}
+	if err := r.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	data := secretData(t, r)
+	if !validCA(data, time.Now()) || !validCert(data, testHosts, time.Now()) {
+		t.Fatalf("expected a valid CA and serving certificate")
+	}
+	for _, key := range []string{tlsCertKey, tlsKeyKey} {
+		written, err := os.ReadFile(filepath.Join(r.CertDir, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(written, data[key]) {
+			t.Errorf("expected %s in the cert dir to match the secret", key)
+		}
+	}
+
+	if err := r.Reader.Get(ctx, client.ObjectKeyFromObject(mutating), mutating); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mutating.Webhooks[0].ClientConfig.CABundle, data[caCertKey]) {
+		t.Errorf("expected the CA in the mutating webhook")
+	}
+	if err := r.Reader.Get(ctx, client.ObjectKeyFromObject(validating), validating); err != nil {
+		t.Fatal(err)
+	}
+	for _, webhook := range validating.Webhooks {
+		if !bytes.Equal(webhook.ClientConfig.CABundle, data[caCertKey]) {
+			t.Errorf("expected the CA in the validating webhook %s", webhook.Name)
+		}
+	}
+	if err := r.Reader.Get(ctx, client.ObjectKeyFromObject(converted), converted); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(converted.Spec.Conversion.Webhook.ClientConfig.CABundle, data[caCertKey]) {
+		t.Errorf("expected the CA in the conversion webhook")
+	}
+	if err := r.Reader.Get(ctx, client.ObjectKeyFromObject(plain), plain); err != nil {
+		t.Fatal(err)
+	}
+	if plain.Spec.Conversion != nil {
+		t.Errorf("expected a CRD without conversion webhook to be left alone")
+	}
+
+	// 证书有效时不重新生成
+	if err := r.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secretData(t, r)[tlsCertKey], data[tlsCertKey]) {
+		t.Errorf("expected a valid certificate to be kept")
+	}
+}
+
+func TestSyncRenew(t *testing.T) {
+	now := time.Now()
+	ca, err := newCA(nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring, err := newServingCert(ca, testHosts, now.Add(rotateBefore/2-certValidity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCA, err := newCA(nil, now.Add(rotateBefore/2-caValidity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldCert, err := newServingCert(oldCA, testHosts, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherHosts, err := newServingCert(ca, testHosts[:1], now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		ca     *keyPair
+		cert   *keyPair
+		keepCA bool
+	}{
+		{
+			name:   "expiring certificate",
+			ca:     ca,
+			cert:   expiring,
+			keepCA: true,
+		},
+		{
+			name:   "missing host",
+			ca:     ca,
+			cert:   otherHosts,
+			keepCA: true,
+		},
+		{
+			name: "expiring CA",
+			ca:   oldCA,
+			cert: oldCert,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRotator(t, &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "system", Name: "webhook-server-cert"},
+				Data: map[string][]byte{
+					caCertKey:  tt.ca.certPEM,
+					caKeyKey:   tt.ca.keyPEM,
+					tlsCertKey: tt.cert.certPEM,
+					tlsKeyKey:  tt.cert.keyPEM,
+				},
+			})
+			if err := r.Sync(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			data := secretData(t, r)
+			if bytes.Equal(data[tlsCertKey], tt.cert.certPEM) {
+				t.Errorf("expected the serving certificate to be renewed")
+			}
+			if !validCert(data, testHosts, now) {
+				t.Errorf("expected the renewed certificate to be valid")
+			}
+			if got := bytes.Equal(data[caCertKey], tt.ca.certPEM); got != tt.keepCA {
+				t.Errorf("expected the CA kept %v, got %v", tt.keepCA, got)
+			}
+			if !tt.keepCA {
+				// 旧 CA 保留在 bundle 中,其他副本换证书之前仍然可信
+				bundle, err := parseCerts(data[caCertKey])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(bundle) != 2 || !bundle[1].Equal(tt.ca.cert) {
+					t.Errorf("expected the previous CA after the new one, got %d certificates", len(bundle))
+				}
+				// ca.crt 即注入的 caBundle,仍然信任旧 CA 签发的证书
+				roots := x509.NewCertPool()
+				for _, cert := range bundle {
+					roots.AddCert(cert)
+				}
+				if _, err := tt.cert.cert.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: now}); err != nil {
+					t.Errorf("expected the injected bundle to trust the previous serving certificate: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
+)
+
+const (
+	// groupField indexes Apps by the IngressGroup named in spec.ingress.group
+	groupField = ".spec.ingress.group"
+	// groupLabel marks the Ingresses merged for an IngressGroup
+	groupLabel = "ingress.mj.learn/group"
+)
+
+// IngressGroupReconciler merges the member Apps of an IngressGroup into one Ingress per namespace
+type IngressGroupReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=ingress.mj.learn,resources=ingressgroups,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=ingress.mj.learn,resources=ingressgroups/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=ingress.mj.learn,resources=ingressgroups/finalizers,verbs=update
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=ingress.mj.learn,resources=apps,verbs=get;list;watch
+
+// Reconcile creates, updates or deletes the shared Ingresses of an IngressGroup so that
+// every namespace with member Apps has one Ingress with a rule per App host.
+func (r *IngressGroupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	group := &ingressv1beta1.IngressGroup{}
+	if err := r.Get(ctx, req.NamespacedName, group); err != nil {
+		// Ingress 通过 OwnerReference 被垃圾回收
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	apps := &ingressv1beta1.AppList{}
+	if err := r.List(ctx, apps, client.MatchingFields{groupField: group.Name}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	members, conflicts := groupMembers(apps.Items)
+	for _, conflict := range conflicts {
+		r.Recorder.Eventf(group, corev1.EventTypeWarning, "HostConflict", "App %s 的 host %s 已由 App %s 使用,未加入 Ingress",
+			conflict.app, conflict.host, conflict.owner)
+	}
+	namespaces := make([]string, 0, len(members))
+	for ns := range members {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+
+	status := ingressv1beta1.IngressGroupStatus{ObservedGeneration: group.Generation}
+	for _, conflict := range conflicts {
+		status.Conflicts = append(status.Conflicts, conflict.app)
+	}
+	for _, ns := range namespaces {
+		desired := newGroupIngress(group, ns, members[ns])
+		i := &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: desired.Name, Namespace: ns}}
+		result, err := controllerutil.CreateOrPatch(ctx, r.Client, i, func() error {
+			mutateIngress(i, desired)
+			setManagedBy(i)
+			return controllerutil.SetControllerReference(group, i, r.Scheme)
+		})
+		if err != nil {
+			r.Recorder.Eventf(group, corev1.EventTypeWarning, "SyncFailed", "同步 Ingress %s/%s 失败: %s", ns, i.Name, err)
+			logger.Error(err, "sync group ingress failed", "namespace", ns)
+			return ctrl.Result{}, err
+		}
+		r.recordResult(group, client.ObjectKeyFromObject(i).String(), result)
+		status.Members += int32(len(members[ns]))
+		status.Ingresses = append(status.Ingresses, client.ObjectKeyFromObject(i).String())
+	}
+
+	// 删除已没有成员的命名空间中的 Ingress,以及按旧的命名方式创建的 Ingress
+	ingresses := &netv1.IngressList{}
+	if err := r.List(ctx, ingresses, client.MatchingLabels{groupLabel: group.Name}); err != nil {
+		return ctrl.Result{}, err
+	}
+	for idx := range ingresses.Items {
+		i := &ingresses.Items[idx]
+		if _, ok := members[i.Namespace]; ok && i.Name == groupIngressName(group.Name) || !metav1.IsControlledBy(i, group) {
+			continue
+		}
+		if err := r.Delete(ctx, i); client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, err
+		}
+		r.recordResult(group, client.ObjectKeyFromObject(i).String(), resultDeleted)
+	}
+
+	if !equality.Semantic.DeepEqual(group.Status, status) {
+		group.Status = status
+		if err := r.Status().Update(ctx, group); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// recordResult emits an event for every merged Ingress that was actually changed.
+func (r *IngressGroupReconciler) recordResult(group *ingressv1beta1.IngressGroup, name string, result controllerutil.OperationResult) {
+	recordChildOperation("Ingress", result)
+	reason, ok := resultReasons[result]
+	if !ok {
+		return
+	}
+	r.Recorder.Eventf(group, corev1.EventTypeNormal, reason, "Ingress %s %s", name, result)
+}
+
+// hostConflict is a member App left out of the shared Ingress because owner, merged before
+// it, already routes host. Both are namespace/name.
+type hostConflict struct {
+	app, owner, host string
+}
+
+// groupMembers returns the Apps to merge by namespace, the Ingress can only route to Services
+// of its own namespace. Apps are taken in namespace and name order, and an App whose host is
+// already routed by a previous one, in any namespace, is reported as a conflict instead.
+func groupMembers(apps []ingressv1beta1.App) (map[string][]ingressv1beta1.App, []hostConflict) {
+	sort.Slice(apps, func(i, j int) bool {
+		if apps[i].Namespace != apps[j].Namespace {
+			return apps[i].Namespace < apps[j].Namespace
+		}
+		return apps[i].Name < apps[j].Name
+	})
+
+	members := map[string][]ingressv1beta1.App{}
+	var conflicts []hostConflict
+	owners := map[string]string{}
+	for _, app := range apps {
+		if !app.Spec.EnableIngress || app.Spec.Suspended || !app.DeletionTimestamp.IsZero() {
+			continue
+		}
+		key, host := client.ObjectKeyFromObject(&app).String(), app.IngressHost()
+		if owner, ok := owners[host]; ok {
+			conflicts = append(conflicts, hostConflict{app: key, owner: owner, host: host})
+			continue
+		}
+		owners[host] = key
+		members[app.Namespace] = append(members[app.Namespace], app)
+	}
+	return members, conflicts
+}
+
+// groupIngressName names the shared Ingress of group. App names are DNS-1035 labels, the dot
+// keeps it from colliding with the Ingress of an App of the same name.
+func groupIngressName(group string) string {
+	return group + ".group"
+}
+
+// newGroupIngress merges apps, all in namespace ns, into one Ingress named by groupIngressName.
+func newGroupIngress(group *ingressv1beta1.IngressGroup, ns string, apps []ingressv1beta1.App) *netv1.Ingress {
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+
+	className := group.Spec.ClassName
+	if className == "" {
+		className = ingressv1beta1.DefaultIngressClassName
+	}
+	pathType := netv1.PathTypePrefix
+	i := &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        groupIngressName(group.Name),
+			Namespace:   ns,
+			Labels:      map[string]string{groupLabel: group.Name},
+			Annotations: group.Spec.Annotations,
+		},
+		Spec: netv1.IngressSpec{IngressClassName: &className},
+	}
+
+	hosts := make([]string, 0, len(apps))
+	for _, app := range apps {
+		host := app.IngressHost()
+		hosts = append(hosts, host)
+		i.Spec.Rules = append(i.Spec.Rules, netv1.IngressRule{
+			Host: host,
+			IngressRuleValue: netv1.IngressRuleValue{
+				HTTP: &netv1.HTTPIngressRuleValue{
+					Paths: []netv1.HTTPIngressPath{{
+						Path:     "/",
+						PathType: &pathType,
+						Backend: netv1.IngressBackend{
+							Service: &netv1.IngressServiceBackend{
+								Name: app.Name,
+								Port: netv1.ServiceBackendPort{Number: appPort(&app)},
+							},
+						},
+					}},
+				},
+			},
+		})
+	}
+	if group.Spec.TLS != nil {
+		i.Spec.TLS = []netv1.IngressTLS{{Hosts: hosts, SecretName: group.Spec.TLS.SecretName}}
+	}
+	return i
+}
+
+// appPort returns the Service port of app, following the fallback of the built-in templates.
+func appPort(app *ingressv1beta1.App) int32 {
+	if app.Spec.Port != 0 {
+		return app.Spec.Port
+	}
+	return ingressv1beta1.DefaultPort
+}
+
+// groupForApp maps an App to the IngressGroup it joins, update events map both the old
+// and the new App so that leaving a group re-merges the old one.
+func groupForApp(obj client.Object) []reconcile.Request {
+	app, ok := obj.(*ingressv1beta1.App)
+	if !ok || app.Spec.Ingress.Group == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: app.Spec.Ingress.Group}}}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *IngressGroupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// groupField 的索引由 AppReconciler 注册,需要先设置 AppReconciler
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&ingressv1beta1.IngressGroup{}).
+		Owns(&netv1.Ingress{}).
+		Watches(&source.Kind{Type: &ingressv1beta1.App{}}, handler.EnqueueRequestsFromMapFunc(groupForApp)).
+		Complete(r)
+}
@@ -0,0 +1,222 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
+)
+
+func TestNewGroupIngress(t *testing.T) {
+	group := &ingressv1beta1.IngressGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "shared"},
+		Spec: ingressv1beta1.IngressGroupSpec{
+			TLS:         &ingressv1beta1.AppIngressTLS{SecretName: "wildcard-tls"},
+			Annotations: map[string]string{"nginx.ingress.kubernetes.io/ssl-redirect": "true"},
+		},
+	}
+	apps := []ingressv1beta1.App{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec:       ingressv1beta1.AppSpec{Port: 8080, Ingress: ingressv1beta1.AppIngress{Host: "www.example.com"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+		},
+	}
+
+	i := newGroupIngress(group, "default", apps)
+	if i.Name != "shared.group" || i.Namespace != "default" || i.Labels[groupLabel] != "shared" {
+		t.Errorf("unexpected metadata %+v", i.ObjectMeta)
+	}
+	if i.Spec.IngressClassName == nil || *i.Spec.IngressClassName != ingressv1beta1.DefaultIngressClassName {
+		t.Errorf("expected default ingressClassName, got %v", i.Spec.IngressClassName)
+	}
+	if i.Annotations["nginx.ingress.kubernetes.io/ssl-redirect"] != "true" {
+		t.Errorf("unexpected annotations %v", i.Annotations)
+	}
+
+	if len(i.Spec.Rules) != 2 {
+		t.Fatalf("expected a rule per app, got %+v", i.Spec.Rules)
+	}
+	// 按 App 名称排序
+	api, web := i.Spec.Rules[0], i.Spec.Rules[1]
+	if api.Host != "api.mj.learn" || api.HTTP.Paths[0].Backend.Service.Name != "api" || api.HTTP.Paths[0].Backend.Service.Port.Number != 80 {
+		t.Errorf("unexpected rule %+v", api)
+	}
+	if web.Host != "www.example.com" || web.HTTP.Paths[0].Backend.Service.Name != "web" || web.HTTP.Paths[0].Backend.Service.Port.Number != 8080 {
+		t.Errorf("unexpected rule %+v", web)
+	}
+
+	if len(i.Spec.TLS) != 1 || i.Spec.TLS[0].SecretName != "wildcard-tls" || len(i.Spec.TLS[0].Hosts) != 2 {
+		t.Errorf("expected a shared tls entry, got %+v", i.Spec.TLS)
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	newApp := func(namespace, name, host string) ingressv1beta1.App {
+		return ingressv1beta1.App{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Spec: ingressv1beta1.AppSpec{
+				EnableIngress: true,
+				Ingress:       ingressv1beta1.AppIngress{Host: host},
+			},
+		}
+	}
+	suspended := newApp("default", "idle", "idle.example.com")
+	suspended.Spec.Suspended = true
+	apps := []ingressv1beta1.App{
+		newApp("prod", "web", "www.example.com"),
+		newApp("default", "web", "www.example.com"),
+		newApp("default", "api", ""),
+		suspended,
+	}
+
+	members, conflicts := groupMembers(apps)
+	if len(members) != 1 || len(members["default"]) != 2 {
+		t.Fatalf("unexpected members %+v", members)
+	}
+	// 先按命名空间排序,default/web 先占用 host
+	want := hostConflict{app: "prod/web", owner: "default/web", host: "www.example.com"}
+	if len(conflicts) != 1 || conflicts[0] != want {
+		t.Errorf("expected conflict %+v, got %+v", want, conflicts)
+	}
+}
+
+func TestGroupIngress(t *testing.T) {
+	scheme := runtime.NewScheme()
+	_ = ingressv1beta1.AddToScheme(scheme)
+	group := &ingressv1beta1.IngressGroup{
+		ObjectMeta: metav1.ObjectMeta{Name: "shared"},
+		Status:     ingressv1beta1.IngressGroupStatus{Conflicts: []string{"default/api"}},
+	}
+	r := &AppReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(group).Build()}
+
+	for _, tc := range []struct {
+		app, group, want string
+	}{
+		{app: "web", group: "shared", want: "shared.group"},
+		{app: "api", group: "shared", want: ""},
+		{app: "web", group: "missing", want: ""},
+	} {
+		app := &ingressv1beta1.App{
+			ObjectMeta: metav1.ObjectMeta{Name: tc.app, Namespace: "default"},
+			Spec:       ingressv1beta1.AppSpec{Ingress: ingressv1beta1.AppIngress{Group: tc.group}},
+		}
+		got, err := r.groupIngress(context.Background(), app)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("app %s in group %s: expected ingress %q, got %q", tc.app, tc.group, tc.want, got)
+		}
+	}
+}
+
+var _ = Describe("IngressGroup controller", func() {
+	const (
+		timeout  = 10 * time.Second
+		interval = 250 * time.Millisecond
+	)
+
+	It("merges member Apps into one Ingress per namespace", func() {
+		group := &ingressv1beta1.IngressGroup{
+			ObjectMeta: metav1.ObjectMeta{Name: "shared"},
+			Spec:       ingressv1beta1.IngressGroupSpec{ClassName: "nginx"},
+		}
+		Expect(k8sClient.Create(ctx, group)).To(Succeed())
+
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "group-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+
+		newMember := func(name string) *ingressv1beta1.App {
+			return &ingressv1beta1.App{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns.Name},
+				Spec: ingressv1beta1.AppSpec{
+					Image:         "nginx:1.23",
+					Replicas:      pointer.Int32(1),
+					EnableService: true,
+					EnableIngress: true,
+					Ingress:       ingressv1beta1.AppIngress{Group: group.Name},
+				},
+			}
+		}
+		web, api := newMember("web"), newMember("api")
+		Expect(k8sClient.Create(ctx, web)).To(Succeed())
+		Expect(k8sClient.Create(ctx, api)).To(Succeed())
+
+		key := types.NamespacedName{Name: groupIngressName(group.Name), Namespace: ns.Name}
+		hosts := func() []string {
+			i := &netv1.Ingress{}
+			if err := k8sClient.Get(ctx, key, i); err != nil {
+				return nil
+			}
+			var hosts []string
+			for _, rule := range i.Spec.Rules {
+				hosts = append(hosts, rule.Host)
+			}
+			return hosts
+		}
+		Eventually(hosts, timeout, interval).Should(Equal([]string{"api.mj.learn", "web.mj.learn"}))
+
+		By("not creating an Ingress per App")
+		Consistently(func() bool {
+			return errors.IsNotFound(k8sClient.Get(ctx, types.NamespacedName{Name: web.Name, Namespace: ns.Name}, &netv1.Ingress{}))
+		}, time.Second, interval).Should(BeTrue())
+
+		By("reporting the members in the status")
+		Eventually(func() ingressv1beta1.IngressGroupStatus {
+			latest := &ingressv1beta1.IngressGroup{}
+			_ = k8sClient.Get(ctx, types.NamespacedName{Name: group.Name}, latest)
+			return latest.Status
+		}, timeout, interval).Should(And(
+			HaveField("Members", int32(2)),
+			HaveField("Ingresses", ConsistOf(key.String())),
+		))
+
+		By("re-merging when an App leaves the group")
+		Eventually(func() error {
+			latest := &ingressv1beta1.App{}
+			if err := k8sClient.Get(ctx, types.NamespacedName{Name: api.Name, Namespace: ns.Name}, latest); err != nil {
+				return err
+			}
+			latest.Spec.Ingress.Group = ""
+			return k8sClient.Update(ctx, latest)
+		}, timeout, interval).Should(Succeed())
+		Eventually(hosts, timeout, interval).Should(Equal([]string{"web.mj.learn"}))
+
+		By("deleting the Ingress once the last App leaves")
+		Expect(k8sClient.Delete(ctx, web)).To(Succeed())
+		Eventually(func() bool {
+			return errors.IsNotFound(k8sClient.Get(ctx, key, &netv1.Ingress{}))
+		}, timeout, interval).Should(BeTrue())
+	})
+})
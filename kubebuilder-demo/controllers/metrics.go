@@ -0,0 +1,138 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
+)
+
+// Phases of an App reported by the apps gauge, derived from its conditions
+const (
+	phaseAvailable     = "Available"
+	phaseProgressing   = "Progressing"
+	phaseFailed        = "Failed"
+	phaseTemplateError = "TemplateError"
+	phaseSuspended     = "Suspended"
+)
+
+var (
+	// skippedEvents counts the watch events dropped by the predicates of the App controller
+	skippedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "app_controller_skipped_events_total",
+		Help: "Number of watch events filtered out by the predicates of the App controller",
+	}, []string{"kind", "event"})
+
+	// appsByPhase is the number of Apps in each phase
+	appsByPhase = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "app_controller_apps",
+		Help: "Number of Apps by phase",
+	}, []string{"phase"})
+
+	// unavailableApps is the number of Apps whose Available condition is False, suspended Apps
+	// are left out. Apps that never got that far, e.g. with a template error, are not counted
+	unavailableApps = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "app_controller_unavailable_apps",
+		Help: "Number of Apps whose Deployment is not fully available",
+	})
+
+	// childOperations counts the child objects created, updated and deleted by kind
+	childOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "app_controller_child_operations_total",
+		Help: "Number of child objects created, updated or deleted by the operator",
+	}, []string{"kind", "operation"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(skippedEvents, appsByPhase, unavailableApps, childOperations)
+}
+
+// recordChildOperation counts a child operation that actually changed the object.
+func recordChildOperation(kind string, result controllerutil.OperationResult) {
+	if result == controllerutil.OperationResultNone {
+		return
+	}
+	childOperations.WithLabelValues(kind, string(result)).Inc()
+}
+
+// appPhase summarizes the conditions of app.
+func appPhase(app *ingressv1beta1.App) string {
+	switch {
+	case meta.IsStatusConditionTrue(app.Status.Conditions, ingressv1beta1.ConditionTemplateError):
+		return phaseTemplateError
+	case meta.IsStatusConditionFalse(app.Status.Conditions, ingressv1beta1.ConditionReconciled):
+		return phaseFailed
+	case meta.IsStatusConditionTrue(app.Status.Conditions, ingressv1beta1.ConditionSuspended):
+		return phaseSuspended
+	case meta.IsStatusConditionTrue(app.Status.Conditions, ingressv1beta1.ConditionAvailable):
+		return phaseAvailable
+	}
+	return phaseProgressing
+}
+
+// appTracker remembers the phase and availability of every reconciled App and keeps the gauges
+// in sync with them.
+type appTracker struct {
+	mu     sync.Mutex
+	phases map[types.NamespacedName]string
+	// unavailable holds the Apps counted by unavailableApps
+	unavailable map[types.NamespacedName]bool
+}
+
+var trackedApps = &appTracker{phases: map[types.NamespacedName]string{}, unavailable: map[types.NamespacedName]bool{}}
+
+// track records the phase and availability of app.
+func (t *appTracker) track(app *ingressv1beta1.App) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := types.NamespacedName{Name: app.Name, Namespace: app.Namespace}
+	t.phases[key] = appPhase(app)
+	if meta.IsStatusConditionFalse(app.Status.Conditions, ingressv1beta1.ConditionAvailable) &&
+		!meta.IsStatusConditionTrue(app.Status.Conditions, ingressv1beta1.ConditionSuspended) {
+		t.unavailable[key] = true
+	} else {
+		delete(t.unavailable, key)
+	}
+	t.update()
+}
+
+// forget drops a deleted App.
+func (t *appTracker) forget(key types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.phases, key)
+	delete(t.unavailable, key)
+	t.update()
+}
+
+func (t *appTracker) update() {
+	counts := map[string]int{phaseAvailable: 0, phaseProgressing: 0, phaseFailed: 0, phaseTemplateError: 0, phaseSuspended: 0}
+	for _, phase := range t.phases {
+		counts[phase]++
+	}
+	for phase, count := range counts {
+		appsByPhase.WithLabelValues(phase).Set(float64(count))
+	}
+	unavailableApps.Set(float64(len(t.unavailable)))
+}
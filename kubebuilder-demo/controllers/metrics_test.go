@@ -0,0 +1,98 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
+)
+
+func newTrackedApp(name string, conditions ...metav1.Condition) *ingressv1beta1.App {
+	app := &ingressv1beta1.App{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	for _, c := range conditions {
+		c.Reason = "Test"
+		meta.SetStatusCondition(&app.Status.Conditions, c)
+	}
+	return app
+}
+
+func TestAppTracker(t *testing.T) {
+	tracker := &appTracker{phases: map[types.NamespacedName]string{}, unavailable: map[types.NamespacedName]bool{}}
+
+	available := newTrackedApp("available",
+		metav1.Condition{Type: ingressv1beta1.ConditionReconciled, Status: metav1.ConditionTrue},
+		metav1.Condition{Type: ingressv1beta1.ConditionAvailable, Status: metav1.ConditionTrue})
+	progressing := newTrackedApp("progressing",
+		metav1.Condition{Type: ingressv1beta1.ConditionReconciled, Status: metav1.ConditionTrue},
+		metav1.Condition{Type: ingressv1beta1.ConditionAvailable, Status: metav1.ConditionFalse})
+	failed := newTrackedApp("failed",
+		metav1.Condition{Type: ingressv1beta1.ConditionReconciled, Status: metav1.ConditionFalse},
+		metav1.Condition{Type: ingressv1beta1.ConditionAvailable, Status: metav1.ConditionFalse})
+	broken := newTrackedApp("broken",
+		metav1.Condition{Type: ingressv1beta1.ConditionTemplateError, Status: metav1.ConditionTrue},
+		metav1.Condition{Type: ingressv1beta1.ConditionReconciled, Status: metav1.ConditionFalse})
+	suspended := newTrackedApp("suspended",
+		metav1.Condition{Type: ingressv1beta1.ConditionReconciled, Status: metav1.ConditionTrue},
+		metav1.Condition{Type: ingressv1beta1.ConditionAvailable, Status: metav1.ConditionFalse},
+		metav1.Condition{Type: ingressv1beta1.ConditionSuspended, Status: metav1.ConditionTrue})
+
+	for _, app := range []*ingressv1beta1.App{available, progressing, failed, broken, suspended} {
+		tracker.track(app)
+	}
+	for phase, want := range map[string]float64{phaseAvailable: 1, phaseProgressing: 1, phaseFailed: 1, phaseTemplateError: 1, phaseSuspended: 1} {
+		if got := testutil.ToFloat64(appsByPhase.WithLabelValues(phase)); got != want {
+			t.Errorf("phase %s: expected %v apps, got %v", phase, want, got)
+		}
+	}
+	// 模板错误的 App 没有 Available condition,不计入
+	if got := testutil.ToFloat64(unavailableApps); got != 2 {
+		t.Errorf("expected 2 unavailable apps, got %v", got)
+	}
+
+	// 状态变化后只统计最新的 phase
+	meta.SetStatusCondition(&progressing.Status.Conditions, metav1.Condition{Type: ingressv1beta1.ConditionAvailable, Status: metav1.ConditionTrue, Reason: "Test"})
+	tracker.track(progressing)
+	tracker.forget(types.NamespacedName{Name: "failed", Namespace: "default"})
+	if got := testutil.ToFloat64(appsByPhase.WithLabelValues(phaseAvailable)); got != 2 {
+		t.Errorf("expected 2 available apps, got %v", got)
+	}
+	if got := testutil.ToFloat64(appsByPhase.WithLabelValues(phaseFailed)); got != 0 {
+		t.Errorf("expected no failed apps, got %v", got)
+	}
+	if got := testutil.ToFloat64(unavailableApps); got != 0 {
+		t.Errorf("expected no unavailable apps, got %v", got)
+	}
+}
+
+func TestRecordChildOperation(t *testing.T) {
+	before := testutil.ToFloat64(childOperations.WithLabelValues("Service", "created"))
+	recordChildOperation("Service", controllerutil.OperationResultCreated)
+	recordChildOperation("Service", controllerutil.OperationResultNone)
+	if got := testutil.ToFloat64(childOperations.WithLabelValues("Service", "created")) - before; got != 1 {
+		t.Errorf("expected one created service, got %v", got)
+	}
+	if got := testutil.ToFloat64(childOperations.WithLabelValues("Service", "unchanged")); got != 0 {
+		t.Errorf("expected unchanged operations not to be counted, got %v", got)
+	}
+}
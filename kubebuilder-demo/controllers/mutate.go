@@ -0,0 +1,187 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The mutate functions copy the fields rendered from the templates onto the live object.
+// Deployments and Services take the rendered spec through applySpec, which only touches the
+// fields the templates render: the values set by the API server, admission webhooks or other
+// tools are kept, so that CreateOrPatch only sends a patch when the operator-owned state
+// really changed.
+
+// lastAppliedAnnotation records the spec last rendered on a Deployment or Service, the fields
+// removed from a template are then removed from the child as well
+const lastAppliedAnnotation = "ingress.mj.learn/last-applied-spec"
+
+func mutateDeployment(d, desired *v1.Deployment) error {
+	d.Labels = mergeStringMap(d.Labels, desired.Labels)
+	d.Annotations = mergeStringMap(d.Annotations, desired.Annotations)
+
+	spec := desired.Spec.DeepCopy()
+	// selector 创建后不可修改
+	if !d.CreationTimestamp.IsZero() {
+		spec.Selector = d.Spec.Selector
+	}
+	// API server 将 serviceAccountName 复制到已废弃的 serviceAccount 字段,清空时两者都需要修改
+	spec.Template.Spec.DeprecatedServiceAccount = spec.Template.Spec.ServiceAccountName
+
+	patched := &v1.Deployment{}
+	if err := applySpec(d, spec, patched); err != nil {
+		return err
+	}
+	d.Spec = patched.Spec
+	return nil
+}
+
+func mutateService(s, desired *corev1.Service) error {
+	s.Labels = mergeStringMap(s.Labels, desired.Labels)
+	s.Annotations = mergeStringMap(s.Annotations, desired.Annotations)
+
+	patched := &corev1.Service{}
+	if err := applySpec(s, &desired.Spec, patched); err != nil {
+		return err
+	}
+	s.Spec = patched.Spec
+	return nil
+}
+
+// applySpec merges spec into obj the way kubectl apply does, with a three-way strategic merge
+// between the spec recorded in lastAppliedAnnotation, spec and obj, and decodes the result
+// into patched. Lists of containers, ports, volumes and the like are merged by key, so the
+// fields the API server defaults inside them are kept too.
+func applySpec(obj client.Object, spec interface{}, patched client.Object) error {
+	modified, err := json.Marshal(map[string]interface{}{"spec": spec})
+	if err != nil {
+		return err
+	}
+	current, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	lookup, err := strategicpatch.NewPatchMetaFromStruct(obj)
+	if err != nil {
+		return err
+	}
+	original := []byte(obj.GetAnnotations()[lastAppliedAnnotation])
+	patch, err := strategicpatch.CreateThreeWayMergePatch(original, modified, current, lookup, true)
+	if err != nil {
+		return err
+	}
+	result, err := strategicpatch.StrategicMergePatchUsingLookupPatchMeta(current, patch, lookup)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(result, patched); err != nil {
+		return err
+	}
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[lastAppliedAnnotation] = string(modified)
+	obj.SetAnnotations(annotations)
+	return nil
+}
+
+// managedAnnotationsAnnotation lists the annotation keys last rendered on an Ingress, the keys
+// removed from spec.ingress.annotations are then removed from the Ingress as well
+const managedAnnotationsAnnotation = "ingress.mj.learn/managed-annotations"
+
+func mutateIngress(i, desired *netv1.Ingress) {
+	i.Labels = mergeStringMap(i.Labels, desired.Labels)
+	i.Annotations = mergeManagedAnnotations(i.Annotations, desired.Annotations)
+	i.Spec.IngressClassName = desired.Spec.IngressClassName
+	i.Spec.DefaultBackend = desired.Spec.DefaultBackend
+	i.Spec.TLS = desired.Spec.TLS
+	i.Spec.Rules = desired.Spec.Rules
+}
+
+func mutateNetworkPolicy(np, desired *netv1.NetworkPolicy) {
+	np.Labels = mergeStringMap(np.Labels, desired.Labels)
+	np.Annotations = mergeStringMap(np.Annotations, desired.Annotations)
+	np.Spec = desired.Spec
+}
+
+func mutateServiceAccount(sa, desired *corev1.ServiceAccount) {
+	sa.Labels = mergeStringMap(sa.Labels, desired.Labels)
+	sa.Annotations = mergeStringMap(sa.Annotations, desired.Annotations)
+}
+
+func mutateRole(role, desired *rbacv1.Role) {
+	role.Labels = mergeStringMap(role.Labels, desired.Labels)
+	role.Annotations = mergeStringMap(role.Annotations, desired.Annotations)
+	role.Rules = desired.Rules
+}
+
+func mutateRoleBinding(binding, desired *rbacv1.RoleBinding) {
+	binding.Labels = mergeStringMap(binding.Labels, desired.Labels)
+	binding.Annotations = mergeStringMap(binding.Annotations, desired.Annotations)
+	binding.Subjects = desired.Subjects
+	// roleRef 创建后不可修改
+	if binding.CreationTimestamp.IsZero() {
+		binding.RoleRef = desired.RoleRef
+	}
+}
+
+// mergeStringMap sets every key of desired on current, keeping keys added by others.
+func mergeStringMap(current, desired map[string]string) map[string]string {
+	if len(desired) == 0 {
+		return current
+	}
+	if current == nil {
+		current = make(map[string]string, len(desired))
+	}
+	for k, v := range desired {
+		current[k] = v
+	}
+	return current
+}
+
+// mergeManagedAnnotations sets every key of desired on current like mergeStringMap, and deletes
+// the keys recorded in managedAnnotationsAnnotation that desired no longer has.
+func mergeManagedAnnotations(current, desired map[string]string) map[string]string {
+	for _, key := range strings.Split(current[managedAnnotationsAnnotation], ",") {
+		if _, ok := desired[key]; !ok {
+			delete(current, key)
+		}
+	}
+	delete(current, managedAnnotationsAnnotation)
+	if len(desired) == 0 {
+		return current
+	}
+
+	keys := make([]string, 0, len(desired))
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	current = mergeStringMap(current, desired)
+	current[managedAnnotationsAnnotation] = strings.Join(keys, ",")
+	return current
+}
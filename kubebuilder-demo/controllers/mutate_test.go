@@ -0,0 +1,298 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
+)
+
+func TestMutateDeploymentKeepsDefaults(t *testing.T) {
+	replicas := int32(2)
+	desired := &v1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "demo"}},
+		Spec: v1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "demo"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "demo"}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "demo", Image: "nginx:1.23", Ports: []corev1.ContainerPort{{ContainerPort: 8080}}}},
+				},
+			},
+		},
+	}
+
+	live := &v1.Deployment{}
+	mustMutateDeployment(t, live, desired)
+
+	// live object as returned by the API server, with defaulted fields, fields set by an
+	// admission webhook and foreign labels
+	live = serverDefaulted(live)
+	live.Labels["owner"] = "someone-else"
+	live.Spec.Template.Spec.PriorityClassName = "tenant-default"
+	live.Spec.Template.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "INJECTED", Value: "true"}}
+	before := live.DeepCopy()
+
+	mustMutateDeployment(t, live, desired)
+	if !equality.Semantic.DeepEqual(before, live) {
+		t.Fatalf("expected no change for an up to date deployment, got %+v", live)
+	}
+
+	newReplicas := int32(3)
+	desired.Spec.Replicas = &newReplicas
+	desired.Spec.Template.Spec.Containers[0].Image = "nginx:1.24"
+	mustMutateDeployment(t, live, desired)
+
+	if *live.Spec.Replicas != 3 || live.Spec.Template.Spec.Containers[0].Image != "nginx:1.24" {
+		t.Errorf("expected replicas and image to be updated, got %+v", live.Spec)
+	}
+	pod := live.Spec.Template.Spec
+	if live.Labels["owner"] != "someone-else" || pod.PriorityClassName != "tenant-default" || len(pod.Containers[0].Env) != 1 {
+		t.Errorf("expected fields not owned by the operator to be kept, got %+v", live)
+	}
+	if pod.Containers[0].ImagePullPolicy != corev1.PullIfNotPresent || pod.Containers[0].Ports[0].Protocol != corev1.ProtocolTCP {
+		t.Errorf("expected the defaulted fields to be kept, got %+v", pod.Containers[0])
+	}
+}
+
+func mustMutateDeployment(t *testing.T, d, desired *v1.Deployment) {
+	t.Helper()
+	if err := mutateDeployment(d, desired); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func mustMutateService(t *testing.T, s, desired *corev1.Service) {
+	t.Helper()
+	if err := mutateService(s, desired); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+// serverDefaulted returns a copy of d as the API server stores it.
+func serverDefaulted(d *v1.Deployment) *v1.Deployment {
+	live := d.DeepCopy()
+	live.CreationTimestamp = metav1.Now()
+	maxUnavailable, maxSurge := intstr.FromString("25%"), intstr.FromString("25%")
+	revisionHistoryLimit, progressDeadlineSeconds := int32(10), int32(600)
+	live.Spec.Strategy = v1.DeploymentStrategy{
+		Type:          v1.RollingUpdateDeploymentStrategyType,
+		RollingUpdate: &v1.RollingUpdateDeployment{MaxUnavailable: &maxUnavailable, MaxSurge: &maxSurge},
+	}
+	live.Spec.RevisionHistoryLimit = &revisionHistoryLimit
+	live.Spec.ProgressDeadlineSeconds = &progressDeadlineSeconds
+
+	pod := &live.Spec.Template.Spec
+	gracePeriod, enableServiceLinks := int64(30), true
+	pod.RestartPolicy = corev1.RestartPolicyAlways
+	pod.TerminationGracePeriodSeconds = &gracePeriod
+	pod.DNSPolicy = corev1.DNSClusterFirst
+	pod.SecurityContext = &corev1.PodSecurityContext{}
+	pod.SchedulerName = "default-scheduler"
+	pod.EnableServiceLinks = &enableServiceLinks
+	for i := range pod.Containers {
+		c := &pod.Containers[i]
+		c.TerminationMessagePath = "/dev/termination-log"
+		c.TerminationMessagePolicy = corev1.TerminationMessageReadFile
+		c.ImagePullPolicy = corev1.PullIfNotPresent
+		for j := range c.Ports {
+			c.Ports[j].Protocol = corev1.ProtocolTCP
+		}
+		if probe := c.ReadinessProbe; probe != nil {
+			probe.TimeoutSeconds, probe.PeriodSeconds, probe.SuccessThreshold, probe.FailureThreshold = 1, 10, 1, 3
+			if probe.HTTPGet != nil {
+				probe.HTTPGet.Scheme = corev1.URISchemeHTTP
+			}
+		}
+	}
+	return live
+}
+
+func TestMutateDeploymentOverriddenFields(t *testing.T) {
+	replicas := int32(2)
+	desired := &v1.Deployment{
+		Spec: v1.DeploymentSpec{
+			Replicas: &replicas,
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "demo"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "demo"}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "demo", Image: "nginx:1.23"}},
+				},
+			},
+		},
+	}
+	live := &v1.Deployment{}
+	mustMutateDeployment(t, live, desired)
+	live = serverDefaulted(live)
+
+	// a templateRef override adds tolerations and a readiness probe to the existing container
+	overridden := desired.DeepCopy()
+	overridden.Spec.Template.Spec.Tolerations = []corev1.Toleration{{Key: "dedicated", Operator: corev1.TolerationOpEqual, Value: "demo", Effect: corev1.TaintEffectNoSchedule}}
+	overridden.Spec.Template.Spec.Containers[0].ReadinessProbe = &corev1.Probe{
+		ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{Path: "/healthz", Port: intstr.FromInt(8080)}},
+	}
+	mustMutateDeployment(t, live, overridden)
+
+	pod := live.Spec.Template.Spec
+	if len(pod.Tolerations) != 1 || pod.Tolerations[0].Key != "dedicated" {
+		t.Errorf("expected the toleration to be applied, got %+v", pod.Tolerations)
+	}
+	probe := pod.Containers[0].ReadinessProbe
+	if probe == nil || probe.HTTPGet == nil || probe.HTTPGet.Path != "/healthz" {
+		t.Fatalf("expected the readiness probe to be applied, got %+v", probe)
+	}
+	if pod.Containers[0].ImagePullPolicy != corev1.PullIfNotPresent || pod.RestartPolicy != corev1.RestartPolicyAlways {
+		t.Errorf("expected the defaulted fields to be kept, got %+v", pod)
+	}
+
+	// once stored and defaulted by the API server nothing changes
+	live = serverDefaulted(live)
+	before := live.DeepCopy()
+	mustMutateDeployment(t, live, overridden)
+	if !equality.Semantic.DeepEqual(before, live) {
+		t.Fatalf("expected no change for an up to date deployment, got %+v", live.Spec.Template.Spec)
+	}
+
+	// removing them from the template removes them from the deployment
+	mustMutateDeployment(t, live, desired)
+	if len(live.Spec.Template.Spec.Tolerations) != 0 || live.Spec.Template.Spec.Containers[0].ReadinessProbe != nil {
+		t.Errorf("expected the toleration and probe to be removed, got %+v", live.Spec.Template.Spec)
+	}
+}
+
+func TestMutateDeploymentServiceAccount(t *testing.T) {
+	desired := &v1.Deployment{}
+	desired.Spec.Template.Spec.ServiceAccountName = "demo"
+
+	live := &v1.Deployment{}
+	mustMutateDeployment(t, live, desired)
+	if live.Spec.Template.Spec.ServiceAccountName != "demo" {
+		t.Errorf("expected serviceAccountName demo, got %q", live.Spec.Template.Spec.ServiceAccountName)
+	}
+
+	// the API server mirrors serviceAccountName into the deprecated field, both are cleared
+	live.Spec.Template.Spec.DeprecatedServiceAccount = "demo"
+	mustMutateDeployment(t, live, &v1.Deployment{})
+	if live.Spec.Template.Spec.ServiceAccountName != "" || live.Spec.Template.Spec.DeprecatedServiceAccount != "" {
+		t.Errorf("expected the service account to be cleared, got %+v", live.Spec.Template.Spec)
+	}
+}
+
+func TestMutateRoleBindingKeepsRoleRef(t *testing.T) {
+	desired := newRoleBinding(&ingressv1beta1.App{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec:       ingressv1beta1.AppSpec{ServiceAccount: &ingressv1beta1.AppServiceAccount{}},
+	})
+
+	live := &rbacv1.RoleBinding{}
+	mutateRoleBinding(live, desired)
+	if live.RoleRef != desired.RoleRef || len(live.Subjects) != 1 || live.Subjects[0].Name != "demo" {
+		t.Fatalf("unexpected role binding %+v", live)
+	}
+
+	// roleRef is immutable once the RoleBinding exists
+	live.CreationTimestamp = metav1.Now()
+	live.RoleRef.Name = "other"
+	mutateRoleBinding(live, desired)
+	if live.RoleRef.Name != "other" {
+		t.Errorf("expected roleRef to be kept, got %+v", live.RoleRef)
+	}
+}
+
+func TestMutateServiceKeepsDefaults(t *testing.T) {
+	desired := &corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "demo"},
+			Ports:    []corev1.ServicePort{{Name: "http", Port: 8080, TargetPort: intstr.FromInt(8080)}},
+		},
+	}
+
+	live := &corev1.Service{}
+	mustMutateService(t, live, desired)
+	live.CreationTimestamp = metav1.Now()
+	live.Spec.ClusterIP = "10.0.0.1"
+	live.Spec.ClusterIPs = []string{"10.0.0.1"}
+	live.Spec.Type = corev1.ServiceTypeClusterIP
+	live.Spec.SessionAffinity = corev1.ServiceAffinityNone
+	live.Spec.Ports[0].Protocol = corev1.ProtocolTCP
+	before := live.DeepCopy()
+
+	mustMutateService(t, live, desired)
+	if !equality.Semantic.DeepEqual(before, live) {
+		t.Fatalf("expected no change for an up to date service, got %+v", live)
+	}
+
+	desired.Spec.Ports[0].TargetPort = intstr.FromInt(80)
+	mustMutateService(t, live, desired)
+	if live.Spec.Ports[0].TargetPort.IntValue() != 80 || live.Spec.ClusterIP != "10.0.0.1" || live.Spec.Ports[0].Protocol != corev1.ProtocolTCP {
+		t.Errorf("expected target port to be updated and the allocated fields kept, got %+v", live.Spec)
+	}
+
+	// fields beyond ports and selector follow the template too
+	overridden := desired.DeepCopy()
+	overridden.Spec.SessionAffinity = corev1.ServiceAffinityClientIP
+	overridden.Spec.PublishNotReadyAddresses = true
+	mustMutateService(t, live, overridden)
+	if live.Spec.SessionAffinity != corev1.ServiceAffinityClientIP || !live.Spec.PublishNotReadyAddresses {
+		t.Errorf("expected the rendered service spec to be applied, got %+v", live.Spec)
+	}
+
+	// and are removed with it
+	mustMutateService(t, live, desired)
+	if live.Spec.SessionAffinity != "" || live.Spec.PublishNotReadyAddresses {
+		t.Errorf("expected the removed fields to be cleared, got %+v", live.Spec)
+	}
+}
+
+func TestMutateIngressRemovesAnnotations(t *testing.T) {
+	desired := &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+		"nginx.ingress.kubernetes.io/rewrite-target": "/",
+		"nginx.ingress.kubernetes.io/ssl-redirect":   "false",
+	}}}
+
+	live := &netv1.Ingress{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"owner": "someone-else"}}}
+	mutateIngress(live, desired)
+	if live.Annotations["nginx.ingress.kubernetes.io/ssl-redirect"] != "false" || live.Annotations["owner"] != "someone-else" {
+		t.Fatalf("expected the rendered annotations to be added, got %v", live.Annotations)
+	}
+
+	// an annotation removed from the App is removed from the Ingress, the others are kept
+	delete(desired.Annotations, "nginx.ingress.kubernetes.io/ssl-redirect")
+	mutateIngress(live, desired)
+	if _, ok := live.Annotations["nginx.ingress.kubernetes.io/ssl-redirect"]; ok {
+		t.Errorf("expected the removed annotation to be deleted, got %v", live.Annotations)
+	}
+	if live.Annotations["nginx.ingress.kubernetes.io/rewrite-target"] != "/" || live.Annotations["owner"] != "someone-else" {
+		t.Errorf("expected the other annotations to be kept, got %v", live.Annotations)
+	}
+
+	mutateIngress(live, &netv1.Ingress{})
+	if len(live.Annotations) != 1 || live.Annotations["owner"] != "someone-else" {
+		t.Errorf("expected only the foreign annotation to be left, got %v", live.Annotations)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/ratelimiter"
+)
+
+// metadataChanged passes updates of the labels or annotations, the operator merges its own into them.
+var metadataChanged = predicate.Or(predicate.LabelChangedPredicate{}, predicate.AnnotationChangedPredicate{})
+
+// deploymentChanged passes Deployment updates that change the spec or the ready replicas
+// reported in the App status, the other status updates of a rollout are dropped.
+var deploymentChanged = predicate.Or(metadataChanged, predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldDeployment, ok := e.ObjectOld.(*v1.Deployment)
+		if !ok {
+			return true
+		}
+		newDeployment, ok := e.ObjectNew.(*v1.Deployment)
+		if !ok {
+			return true
+		}
+		return oldDeployment.Generation != newDeployment.Generation ||
+			oldDeployment.Status.ReadyReplicas != newDeployment.Status.ReadyReplicas
+	},
+})
+
+// serviceChanged passes Service updates that change the spec, Services do not bump their generation.
+var serviceChanged = predicate.Or(metadataChanged, predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldService, ok := e.ObjectOld.(*corev1.Service)
+		if !ok {
+			return true
+		}
+		newService, ok := e.ObjectNew.(*corev1.Service)
+		if !ok {
+			return true
+		}
+		return !equality.Semantic.DeepEqual(oldService.Spec, newService.Spec)
+	},
+})
+
+// ingressChanged passes Ingress updates that change the spec, dropping load balancer status updates.
+var ingressChanged = predicate.Or(metadataChanged, predicate.GenerationChangedPredicate{})
+
+// networkPolicyChanged passes NetworkPolicy updates that change the spec.
+var networkPolicyChanged = predicate.Or(metadataChanged, predicate.GenerationChangedPredicate{})
+
+// roleChanged passes Role updates that change the rules, RBAC objects do not bump their generation.
+var roleChanged = predicate.Or(metadataChanged, predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldRole, ok := e.ObjectOld.(*rbacv1.Role)
+		if !ok {
+			return true
+		}
+		newRole, ok := e.ObjectNew.(*rbacv1.Role)
+		if !ok {
+			return true
+		}
+		return !equality.Semantic.DeepEqual(oldRole.Rules, newRole.Rules)
+	},
+})
+
+// roleBindingChanged passes RoleBinding updates that change the subjects or the role.
+var roleBindingChanged = predicate.Or(metadataChanged, predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldBinding, ok := e.ObjectOld.(*rbacv1.RoleBinding)
+		if !ok {
+			return true
+		}
+		newBinding, ok := e.ObjectNew.(*rbacv1.RoleBinding)
+		if !ok {
+			return true
+		}
+		return !equality.Semantic.DeepEqual(oldBinding.Subjects, newBinding.Subjects) ||
+			oldBinding.RoleRef != newBinding.RoleRef
+	},
+})
+
+// countSkipped wraps p, counting the events it drops in skippedEvents by kind.
+func countSkipped(kind string, p predicate.Predicate) predicate.Predicate {
+	record := func(event string, ok bool) bool {
+		if !ok {
+			skippedEvents.WithLabelValues(kind, event).Inc()
+		}
+		return ok
+	}
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return record("create", p.Create(e))
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return record("update", p.Update(e))
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return record("delete", p.Delete(e))
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return record("generic", p.Generic(e))
+		},
+	}
+}
+
+// NewRateLimiter returns the requeue rate limiter of the App controller: a per App exponential
+// backoff between baseDelay and maxDelay, bounded overall by qps and burst. Zero values fall
+// back to those of workqueue.DefaultControllerRateLimiter.
+func NewRateLimiter(baseDelay, maxDelay time.Duration, qps float64, burst int) ratelimiter.RateLimiter {
+	if baseDelay == 0 {
+		baseDelay = 5 * time.Millisecond
+	}
+	if maxDelay == 0 {
+		maxDelay = 1000 * time.Second
+	}
+	if qps == 0 {
+		qps = 10
+	}
+	if burst == 0 {
+		burst = 100
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(baseDelay, maxDelay),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(qps), burst)},
+	)
+}
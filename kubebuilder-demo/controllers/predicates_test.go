@@ -0,0 +1,142 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	v1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+)
+
+func TestDeploymentChanged(t *testing.T) {
+	old := &v1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "demo", Generation: 1}}
+
+	tests := []struct {
+		name   string
+		mutate func(d *v1.Deployment)
+		want   bool
+	}{
+		{
+			name:   "rollout progress",
+			mutate: func(d *v1.Deployment) { d.Status.UpdatedReplicas = 1; d.Status.ObservedGeneration = 1 },
+			want:   false,
+		},
+		{
+			name:   "ready replicas",
+			mutate: func(d *v1.Deployment) { d.Status.ReadyReplicas = 1 },
+			want:   true,
+		},
+		{
+			name:   "spec",
+			mutate: func(d *v1.Deployment) { d.Generation = 2 },
+			want:   true,
+		},
+		{
+			name:   "labels",
+			mutate: func(d *v1.Deployment) { d.Labels = map[string]string{"app": "other"} },
+			want:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := old.DeepCopy()
+			tt.mutate(updated)
+			if got := deploymentChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestServiceChanged(t *testing.T) {
+	old := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo"},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 80}}},
+	}
+
+	updated := old.DeepCopy()
+	updated.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "10.0.0.1"}}
+	if serviceChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}) {
+		t.Errorf("expected a status update to be dropped")
+	}
+
+	updated = old.DeepCopy()
+	updated.Spec.Ports[0].Port = 8080
+	if !serviceChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}) {
+		t.Errorf("expected a spec update to pass")
+	}
+}
+
+func TestRoleChanged(t *testing.T) {
+	old := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", ResourceVersion: "1"},
+		Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}},
+	}
+
+	updated := old.DeepCopy()
+	updated.ResourceVersion = "2"
+	if roleChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}) {
+		t.Errorf("expected a resync to be dropped")
+	}
+
+	updated = old.DeepCopy()
+	updated.Rules[0].Verbs = append(updated.Rules[0].Verbs, "list")
+	if !roleChanged.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}) {
+		t.Errorf("expected a rules update to pass")
+	}
+}
+
+func TestCountSkipped(t *testing.T) {
+	old := &v1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "demo", Generation: 1}}
+	updated := old.DeepCopy()
+	updated.Status.ObservedGeneration = 1
+
+	p := countSkipped("Test", deploymentChanged)
+	before := testutil.ToFloat64(skippedEvents.WithLabelValues("Test", "update"))
+	if p.Update(event.UpdateEvent{ObjectOld: old, ObjectNew: updated}) {
+		t.Fatalf("expected the update to be dropped")
+	}
+	if !p.Create(event.CreateEvent{Object: old}) {
+		t.Fatalf("expected the create to pass")
+	}
+	if got := testutil.ToFloat64(skippedEvents.WithLabelValues("Test", "update")) - before; got != 1 {
+		t.Errorf("expected one skipped update, got %v", got)
+	}
+	if got := testutil.ToFloat64(skippedEvents.WithLabelValues("Test", "create")); got != 0 {
+		t.Errorf("expected no skipped create, got %v", got)
+	}
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(time.Second, 4*time.Second, 0, 0)
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second} {
+		if got := limiter.When("default/demo"); got != want {
+			t.Errorf("retry %d: expected %s, got %s", i, want, got)
+		}
+	}
+	limiter.Forget("default/demo")
+	if got := limiter.When("default/demo"); got != time.Second {
+		t.Errorf("expected the backoff to reset, got %s", got)
+	}
+}
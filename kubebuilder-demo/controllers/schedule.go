@@ -0,0 +1,103 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
+)
+
+const (
+	// scheduleLookback bounds the search for the last activation of a schedule, cron gives up
+	// looking for the next one after five years as well
+	scheduleLookback = 5 * 365 * 24 * time.Hour
+	// minScheduleRequeue is the shortest wait for the next window, it may already have opened
+	minScheduleRequeue = time.Second
+)
+
+// Clock knows how to get the current time, tests replace it to move between schedule windows.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// scheduledReplicas returns the replicas of the window of app.Spec.Schedules active at now,
+// spec.replicas when no schedule activated within scheduleLookback, and the next window. A window opened by the last
+// activation of a schedule lasts until another schedule activates, later schedules win
+// when several activate at the same time.
+func scheduledReplicas(app *ingressv1beta1.App, now time.Time) (int32, *ingressv1beta1.AppScheduledAction, error) {
+	replicas := int32(1)
+	if app.Spec.Replicas != nil {
+		replicas = *app.Spec.Replicas
+	}
+	var activeAt time.Time
+	var next *ingressv1beta1.AppScheduledAction
+
+	for _, s := range app.Spec.Schedules {
+		loc, err := time.LoadLocation(s.TimeZone)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid time zone %q: %w", s.TimeZone, err)
+		}
+		schedule, err := cron.ParseStandard(s.Schedule)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid schedule %q: %w", s.Schedule, err)
+		}
+
+		last := lastActivation(schedule, now.In(loc))
+		if !last.IsZero() && !last.Before(activeAt) {
+			replicas = s.Replicas
+			activeAt = last
+		}
+
+		// Next 找不到下一次激活时返回零值
+		if t := schedule.Next(now.In(loc)); !t.IsZero() && (next == nil || !t.After(next.Time.Time)) {
+			next = &ingressv1beta1.AppScheduledAction{Time: metav1.NewTime(t), Replicas: s.Replicas}
+		}
+	}
+
+	return replicas, next, nil
+}
+
+// lastActivation returns the last activation of schedule at or before now, zero when there is
+// none within scheduleLookback. It looks back from now in doubling windows, so a schedule
+// firing every minute is not walked through a whole week while a yearly one is still found.
+func lastActivation(schedule cron.Schedule, now time.Time) time.Time {
+	for window := time.Minute; ; window *= 2 {
+		if window > scheduleLookback {
+			window = scheduleLookback
+		}
+		// 窗口减半时没有激活,最后一次激活在窗口的前半段
+		if t := schedule.Next(now.Add(-window)); !t.IsZero() && !t.After(now) {
+			last := t
+			for t = schedule.Next(t); !t.IsZero() && !t.After(now); t = schedule.Next(t) {
+				last = t
+			}
+			return last
+		}
+		if window == scheduleLookback {
+			return time.Time{}
+		}
+	}
+}
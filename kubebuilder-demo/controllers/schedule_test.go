@@ -0,0 +1,209 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/pointer"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
+	"kubebuilder-demo/controllers/template"
+	"kubebuilder-demo/controllers/utils"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+// 工作日 20:00 缩容到 0,08:00 恢复到 3
+var officeHours = []ingressv1beta1.AppSchedule{
+	{Schedule: "0 8 * * 1-5", Replicas: 3, TimeZone: "Asia/Shanghai"},
+	{Schedule: "0 20 * * 1-5", Replicas: 0, TimeZone: "Asia/Shanghai"},
+}
+
+func TestScheduledReplicas(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		schedules []ingressv1beta1.AppSchedule
+		now       time.Time
+		want      int32
+		wantNext  *ingressv1beta1.AppScheduledAction
+	}{
+		{
+			name: "no schedules",
+			now:  time.Date(2022, 7, 6, 12, 0, 0, 0, shanghai),
+			want: 1,
+		},
+		{
+			name:      "office hours",
+			schedules: officeHours,
+			now:       time.Date(2022, 7, 6, 12, 0, 0, 0, shanghai),
+			want:      3,
+			wantNext:  &ingressv1beta1.AppScheduledAction{Time: metav1.NewTime(time.Date(2022, 7, 6, 20, 0, 0, 0, shanghai)), Replicas: 0},
+		},
+		{
+			name:      "window boundary",
+			schedules: officeHours,
+			now:       time.Date(2022, 7, 6, 20, 0, 0, 0, shanghai),
+			want:      0,
+			wantNext:  &ingressv1beta1.AppScheduledAction{Time: metav1.NewTime(time.Date(2022, 7, 7, 8, 0, 0, 0, shanghai)), Replicas: 3},
+		},
+		{
+			name:      "weekend",
+			schedules: officeHours,
+			now:       time.Date(2022, 7, 9, 12, 0, 0, 0, shanghai),
+			want:      0,
+			wantNext:  &ingressv1beta1.AppScheduledAction{Time: metav1.NewTime(time.Date(2022, 7, 11, 8, 0, 0, 0, shanghai)), Replicas: 3},
+		},
+		{
+			name:      "time zone",
+			schedules: officeHours,
+			// 12:00 UTC 是上海时间 20:00
+			now:      time.Date(2022, 7, 6, 12, 0, 0, 0, time.UTC),
+			want:     0,
+			wantNext: &ingressv1beta1.AppScheduledAction{Time: metav1.NewTime(time.Date(2022, 7, 7, 8, 0, 0, 0, shanghai)), Replicas: 3},
+		},
+		{
+			name:      "yearly",
+			schedules: []ingressv1beta1.AppSchedule{{Schedule: "0 0 1 1 *", Replicas: 5}},
+			now:       time.Date(2022, 7, 6, 12, 0, 0, 0, time.UTC),
+			want:      5,
+			wantNext:  &ingressv1beta1.AppScheduledAction{Time: metav1.NewTime(time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)), Replicas: 5},
+		},
+		{
+			name:      "every minute",
+			schedules: []ingressv1beta1.AppSchedule{{Schedule: "0 0 1 1 *", Replicas: 5}, {Schedule: "* * * * *", Replicas: 2}},
+			now:       time.Date(2022, 7, 6, 12, 0, 30, 0, time.UTC),
+			want:      2,
+			wantNext:  &ingressv1beta1.AppScheduledAction{Time: metav1.NewTime(time.Date(2022, 7, 6, 12, 1, 0, 0, time.UTC)), Replicas: 2},
+		},
+		{
+			name:      "never activated",
+			schedules: []ingressv1beta1.AppSchedule{{Schedule: "0 0 30 2 *", Replicas: 5}},
+			now:       time.Date(2022, 7, 6, 12, 0, 0, 0, time.UTC),
+			want:      1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &ingressv1beta1.App{Spec: ingressv1beta1.AppSpec{Replicas: pointer.Int32(1), Schedules: tt.schedules}}
+			got, next, err := scheduledReplicas(app, tt.now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %d replicas, got %d", tt.want, got)
+			}
+			switch {
+			case tt.wantNext == nil && next != nil:
+				t.Errorf("expected no next schedule, got %+v", next)
+			case tt.wantNext != nil && (next == nil || !next.Time.Equal(&tt.wantNext.Time) || next.Replicas != tt.wantNext.Replicas):
+				t.Errorf("expected next schedule %+v, got %+v", tt.wantNext, next)
+			}
+		})
+	}
+
+	app := &ingressv1beta1.App{Spec: ingressv1beta1.AppSpec{Schedules: []ingressv1beta1.AppSchedule{{Schedule: "not a cron"}}}}
+	if _, _, err := scheduledReplicas(app, time.Now()); err == nil {
+		t.Errorf("expected an invalid schedule to fail")
+	}
+}
+
+func TestReconcileSchedules(t *testing.T) {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ingressv1beta1.AddToScheme(scheme); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	templates, err := utils.ParseTemplates(template.FS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	app := &ingressv1beta1.App{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec:       ingressv1beta1.AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(1), Schedules: officeHours},
+	}
+	clock := &fakeClock{now: time.Date(2022, 7, 6, 4, 0, 0, 0, time.UTC)}
+	r := &AppReconciler{
+		Client:    fake.NewClientBuilder().WithScheme(scheme).WithObjects(app).Build(),
+		Scheme:    scheme,
+		Recorder:  record.NewFakeRecorder(100),
+		Templates: templates,
+		Clock:     clock,
+	}
+	req := ctrl.Request{NamespacedName: client.ObjectKeyFromObject(app)}
+
+	reconcile := func() (ctrl.Result, int32) {
+		result, err := r.Reconcile(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		d := &v1.Deployment{}
+		if err := r.Get(context.Background(), req.NamespacedName, d); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return result, *d.Spec.Replicas
+	}
+
+	// 上海时间 12:00,处于 08:00 开始的窗口
+	result, replicas := reconcile()
+	if replicas != 3 {
+		t.Errorf("expected 3 replicas, got %d", replicas)
+	}
+	if result.RequeueAfter != 8*time.Hour {
+		t.Errorf("expected a requeue at 20:00, got %v", result.RequeueAfter)
+	}
+	latest := &ingressv1beta1.App{}
+	if err := r.Get(context.Background(), req.NamespacedName, latest); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if next := latest.Status.NextSchedule; next == nil || next.Replicas != 0 || !next.Time.Time.Equal(clock.now.Add(8*time.Hour)) {
+		t.Errorf("unexpected next schedule %+v", next)
+	}
+
+	// 到达下一个窗口
+	clock.now = clock.now.Add(result.RequeueAfter)
+	result, replicas = reconcile()
+	if replicas != 0 {
+		t.Errorf("expected 0 replicas, got %d", replicas)
+	}
+	if result.RequeueAfter != 12*time.Hour {
+		t.Errorf("expected a requeue at 08:00, got %v", result.RequeueAfter)
+	}
+}
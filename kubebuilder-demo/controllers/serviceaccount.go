@@ -0,0 +1,135 @@
+/*
+Copyright 2022.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
+)
+
+// reconcileServiceAccount creates the ServiceAccount of app and, when spec.serviceAccount.rules is
+// set, the Role and RoleBinding granting the rules to it. Children of cleared settings are deleted.
+func (r *AppReconciler) reconcileServiceAccount(ctx context.Context, app *ingressv1beta1.App) error {
+	key := types.NamespacedName{Name: app.Name, Namespace: app.Namespace}
+
+	if app.Spec.ServiceAccount == nil {
+		if err := r.deleteRole(ctx, app, key); err != nil {
+			return err
+		}
+		if err := r.deleteChild(ctx, app, &corev1.ServiceAccount{}, key); err != nil {
+			return err
+		}
+		app.Status.ServiceAccountName = ""
+		return nil
+	}
+
+	desired := newServiceAccount(app)
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: desired.Name, Namespace: desired.Namespace}}
+	if err := r.createOrPatch(ctx, app, sa, func() error {
+		mutateServiceAccount(sa, desired)
+		return nil
+	}); err != nil {
+		return err
+	}
+	app.Status.ServiceAccountName = sa.Name
+
+	if len(app.Spec.ServiceAccount.Rules) == 0 {
+		return r.deleteRole(ctx, app, key)
+	}
+	// 准入之后 manager 的 allowlist 可能已经收紧,不再授予超出范围的权限
+	if err := app.ValidateRoleRules(); err != nil {
+		r.Recorder.Eventf(app, corev1.EventTypeWarning, "RulesRejected", "Role %s 的规则超出允许范围: %s", key.Name, err)
+		if err := r.deleteRole(ctx, app, key); err != nil {
+			return err
+		}
+		return err
+	}
+
+	desiredRole := newRole(app)
+	role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: desiredRole.Name, Namespace: desiredRole.Namespace}}
+	if err := r.createOrPatch(ctx, app, role, func() error {
+		mutateRole(role, desiredRole)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	desiredBinding := newRoleBinding(app)
+	binding := &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: desiredBinding.Name, Namespace: desiredBinding.Namespace}}
+	return r.createOrPatch(ctx, app, binding, func() error {
+		mutateRoleBinding(binding, desiredBinding)
+		return nil
+	})
+}
+
+// deleteRole deletes the RoleBinding and Role of app.
+func (r *AppReconciler) deleteRole(ctx context.Context, app *ingressv1beta1.App, key types.NamespacedName) error {
+	for _, obj := range []client.Object{&rbacv1.RoleBinding{}, &rbacv1.Role{}} {
+		if err := r.deleteChild(ctx, app, obj, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newServiceAccount(app *ingressv1beta1.App) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      app.Name,
+			Namespace: app.Namespace,
+			Labels:    map[string]string{"app": app.Name},
+		},
+	}
+}
+
+func newRole(app *ingressv1beta1.App) *rbacv1.Role {
+	return &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      app.Name,
+			Namespace: app.Namespace,
+			Labels:    map[string]string{"app": app.Name},
+		},
+		Rules: app.Spec.ServiceAccount.Rules,
+	}
+}
+
+func newRoleBinding(app *ingressv1beta1.App) *rbacv1.RoleBinding {
+	return &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      app.Name,
+			Namespace: app.Namespace,
+			Labels:    map[string]string{"app": app.Name},
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      app.Name,
+			Namespace: app.Namespace,
+		}},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     app.Name,
+		},
+	}
+}
@@ -0,0 +1,9 @@
+// Package template embeds the built-in manifests rendered for every App.
+package template
+
+import "embed"
+
+// FS holds deployment.yaml, service.yaml, ingress.yaml and networkpolicy.yaml.
+//
+//go:embed *.yaml
+var FS embed.FS
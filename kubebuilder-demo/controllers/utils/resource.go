@@ -2,50 +2,203 @@ package utils
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"text/template"
+	"time"
 
 	"kubebuilder-demo/api/v1beta1"
 
+	"github.com/prometheus/client_golang/prometheus"
 	appv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 )
 
-func parseTemplate(templateName string, app *v1beta1.App) []byte {
-	tmpl, err := template.ParseFiles("controllers/template/" + templateName + ".yaml")
+const (
+	deploymentTemplate    = "deployment"
+	serviceTemplate       = "service"
+	ingressTemplate       = "ingress"
+	networkPolicyTemplate = "networkpolicy"
+)
+
+// TemplateError is returned when a template cannot be parsed, rendered or decoded into its object.
+type TemplateError struct {
+	Template string
+	Err      error
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("template %s: %s", e.Template, e.Err.Error())
+}
+
+func (e *TemplateError) Unwrap() error {
+	return e.Err
+}
+
+// IsTemplateError reports whether err was caused by a template.
+func IsTemplateError(err error) bool {
+	var templateErr *TemplateError
+	return errors.As(err, &templateErr)
+}
+
+// Templates holds the parsed Deployment, Service, Ingress and NetworkPolicy templates.
+type Templates struct {
+	deployment    *template.Template
+	service       *template.Template
+	ingress       *template.Template
+	networkPolicy *template.Template
+}
+
+// ParseTemplates parses deployment.yaml, service.yaml, ingress.yaml and networkpolicy.yaml from fsys and
+// renders each of them once against a sample App, so broken templates fail at startup.
+func ParseTemplates(fsys fs.FS) (*Templates, error) {
+	t := &Templates{}
+	for name, tmpl := range map[string]**template.Template{
+		deploymentTemplate:    &t.deployment,
+		serviceTemplate:       &t.service,
+		ingressTemplate:       &t.ingress,
+		networkPolicyTemplate: &t.networkPolicy,
+	} {
+		parsed, err := template.New(name+".yaml").Funcs(funcs).ParseFS(fsys, name+".yaml")
+		if err != nil {
+			return nil, &TemplateError{Template: name, Err: err}
+		}
+		*tmpl = parsed
+	}
+
+	if err := t.validate(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// WithOverrides returns a copy of t where every template found in data, keyed by
+// deployment.yaml, service.yaml, ingress.yaml or networkpolicy.yaml, replaces the built-in one.
+func (t *Templates) WithOverrides(data map[string]string) (*Templates, error) {
+	overridden := *t
+	for name, tmpl := range map[string]**template.Template{
+		deploymentTemplate:    &overridden.deployment,
+		serviceTemplate:       &overridden.service,
+		ingressTemplate:       &overridden.ingress,
+		networkPolicyTemplate: &overridden.networkPolicy,
+	} {
+		text, ok := data[name+".yaml"]
+		if !ok {
+			continue
+		}
+		parsed, err := template.New(name + ".yaml").Funcs(funcs).Parse(text)
+		if err != nil {
+			return nil, &TemplateError{Template: name, Err: err}
+		}
+		*tmpl = parsed
+	}
+
+	if err := overridden.validate(); err != nil {
+		return nil, err
+	}
+	return &overridden, nil
+}
+
+func (t *Templates) validate() error {
+	sample := &v1beta1.App{
+		ObjectMeta: metav1.ObjectMeta{Name: "sample", Namespace: "default"},
+		Spec:       v1beta1.AppSpec{Image: "nginx:latest", Replicas: pointer.Int32(1)},
+	}
+	if _, err := t.NewDeployment(sample); err != nil {
+		return err
+	}
+	if _, err := t.NewService(sample); err != nil {
+		return err
+	}
+	if _, err := t.NewIngress(sample); err != nil {
+		return err
+	}
+	if _, err := t.NewNetworkPolicy(sample); err != nil {
+		return err
+	}
+	return nil
+}
+
+// funcs are available to the built-in and overriding templates, toJson renders a value inline
+// since JSON is valid YAML
+var funcs = template.FuncMap{
+	"toJson": toJSON,
+}
+
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
 	if err != nil {
-		panic(err)
+		return "", err
 	}
+	return string(b), nil
+}
+
+// renderDuration observes the time taken to render and decode each template
+var renderDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "app_template_render_duration_seconds",
+	Help:    "Time taken to render and decode a child object template",
+	Buckets: prometheus.ExponentialBuckets(0.0001, 2, 12),
+}, []string{"template"})
+
+func init() {
+	metrics.Registry.MustRegister(renderDuration)
+}
+
+// render executes tmpl against app and decodes the result into obj. The name and namespace of obj
+// always follow app, whatever the template says, so that an overriding template cannot point a
+// child at another object.
+func render(name string, tmpl *template.Template, app *v1beta1.App, obj metav1.Object) error {
+	defer func(start time.Time) {
+		renderDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}(time.Now())
+
 	b := new(bytes.Buffer)
-	if err = tmpl.Execute(b, app); err != nil {
-		panic(err)
+	if err := tmpl.Execute(b, app); err != nil {
+		return &TemplateError{Template: name, Err: err}
 	}
-	return b.Bytes()
+	if err := yaml.Unmarshal(b.Bytes(), obj); err != nil {
+		return &TemplateError{Template: name, Err: err}
+	}
+	obj.SetName(app.Name)
+	obj.SetNamespace(app.Namespace)
+	return nil
 }
-func NewDeployment(app *v1beta1.App) *appv1.Deployment {
+
+func (t *Templates) NewDeployment(app *v1beta1.App) (*appv1.Deployment, error) {
 	d := &appv1.Deployment{}
-	err := yaml.Unmarshal(parseTemplate("deployment", app), d)
-	if err != nil {
-		panic(err)
+	if err := render(deploymentTemplate, t.deployment, app, d); err != nil {
+		return nil, err
 	}
-	return d
+	return d, nil
 }
 
-func NewIngress(app *v1beta1.App) *netv1.Ingress {
+func (t *Templates) NewIngress(app *v1beta1.App) (*netv1.Ingress, error) {
 	i := &netv1.Ingress{}
-	err := yaml.Unmarshal(parseTemplate("ingress", app), i)
-	if err != nil {
-		panic(err)
+	if err := render(ingressTemplate, t.ingress, app, i); err != nil {
+		return nil, err
 	}
-	return i
+	return i, nil
 }
 
-func NewService(app *v1beta1.App) *corev1.Service {
+func (t *Templates) NewService(app *v1beta1.App) (*corev1.Service, error) {
 	s := &corev1.Service{}
-	err := yaml.Unmarshal(parseTemplate("service", app), s)
-	if err != nil {
-		panic(err)
+	if err := render(serviceTemplate, t.service, app, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (t *Templates) NewNetworkPolicy(app *v1beta1.App) (*netv1.NetworkPolicy, error) {
+	np := &netv1.NetworkPolicy{}
+	if err := render(networkPolicyTemplate, t.networkPolicy, app, np); err != nil {
+		return nil, err
 	}
-	return s
+	return np, nil
 }
@@ -0,0 +1,478 @@
+package utils
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"kubebuilder-demo/api/v1beta1"
+	"kubebuilder-demo/controllers/template"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/pointer"
+)
+
+func newApp() *v1beta1.App {
+	return &v1beta1.App{
+		ObjectMeta: metav1.ObjectMeta{Name: "demo", Namespace: "default"},
+		Spec:       v1beta1.AppSpec{Image: "nginx:1.23", Replicas: pointer.Int32(2)},
+	}
+}
+
+func TestParseEmbeddedTemplates(t *testing.T) {
+	templates, err := ParseTemplates(template.FS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	d, err := templates.NewDeployment(newApp())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.Name != "demo" || *d.Spec.Replicas != 2 || d.Spec.Template.Spec.Containers[0].Image != "nginx:1.23" {
+		t.Errorf("unexpected deployment %+v", d)
+	}
+
+	s, err := templates.NewService(newApp())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Name != "demo" || s.Spec.Selector["app"] != "demo" {
+		t.Errorf("unexpected service %+v", s)
+	}
+
+	i, err := templates.NewIngress(newApp())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if i.Name != "demo" || i.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Name != "demo" {
+		t.Errorf("unexpected ingress %+v", i)
+	}
+}
+
+func TestTemplatesRenderPortsAndIngress(t *testing.T) {
+	templates, err := ParseTemplates(template.FS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	app := newApp()
+	app.Spec.Port = 8080
+	app.Spec.TargetPort = 3000
+	app.Spec.Ingress = v1beta1.AppIngress{
+		Host:        "demo.example.com",
+		ClassName:   "traefik",
+		TLS:         &v1beta1.AppIngressTLS{SecretName: "demo-tls"},
+		Annotations: map[string]string{"traefik.ingress.kubernetes.io/router.tls": "true"},
+	}
+
+	d, err := templates.NewDeployment(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if port := d.Spec.Template.Spec.Containers[0].Ports[0].ContainerPort; port != 3000 {
+		t.Errorf("expected containerPort 3000, got %d", port)
+	}
+
+	s, err := templates.NewService(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p := s.Spec.Ports[0]; p.Port != 8080 || p.TargetPort.IntVal != 3000 {
+		t.Errorf("unexpected service port %+v", p)
+	}
+
+	i, err := templates.NewIngress(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if i.Spec.Rules[0].Host != "demo.example.com" || i.Spec.Rules[0].HTTP.Paths[0].Backend.Service.Port.Number != 8080 {
+		t.Errorf("unexpected ingress rules %+v", i.Spec.Rules)
+	}
+	if i.Spec.IngressClassName == nil || *i.Spec.IngressClassName != "traefik" {
+		t.Errorf("expected ingressClassName traefik, got %v", i.Spec.IngressClassName)
+	}
+	if len(i.Spec.TLS) != 1 || i.Spec.TLS[0].SecretName != "demo-tls" || i.Spec.TLS[0].Hosts[0] != "demo.example.com" {
+		t.Errorf("unexpected ingress tls %+v", i.Spec.TLS)
+	}
+	if i.Annotations["traefik.ingress.kubernetes.io/router.tls"] != "true" {
+		t.Errorf("unexpected ingress annotations %v", i.Annotations)
+	}
+
+	// 未设置时使用默认值
+	i, err = templates.NewIngress(newApp())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if i.Spec.Rules[0].Host != "demo.mj.learn" || *i.Spec.IngressClassName != "nginx" || len(i.Spec.TLS) != 0 {
+		t.Errorf("unexpected default ingress %+v", i.Spec)
+	}
+}
+
+func TestTemplatesRenderConfigSources(t *testing.T) {
+	templates, err := ParseTemplates(template.FS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	app := newApp()
+	app.Spec.ConfigMaps = []v1beta1.AppConfigSource{
+		{Name: "demo-config", MountPath: "/etc/demo"},
+		{Name: "demo-env", EnvFrom: true},
+	}
+	app.Spec.Secrets = []v1beta1.AppConfigSource{
+		{Name: "demo-credentials", EnvFrom: true},
+		{Name: "demo-tls", MountPath: "/etc/tls"},
+	}
+
+	d, err := templates.NewDeployment(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := d.Spec.Template.Spec.Containers[0]
+	if len(c.EnvFrom) != 2 || c.EnvFrom[0].ConfigMapRef.Name != "demo-env" || c.EnvFrom[1].SecretRef.Name != "demo-credentials" {
+		t.Errorf("unexpected envFrom %+v", c.EnvFrom)
+	}
+	if len(c.VolumeMounts) != 2 || c.VolumeMounts[0].MountPath != "/etc/demo" || c.VolumeMounts[1].MountPath != "/etc/tls" {
+		t.Errorf("unexpected volumeMounts %+v", c.VolumeMounts)
+	}
+	volumes := d.Spec.Template.Spec.Volumes
+	if len(volumes) != 2 || volumes[0].Name != c.VolumeMounts[0].Name || volumes[1].Name != c.VolumeMounts[1].Name {
+		t.Fatalf("unexpected volumes %+v", volumes)
+	}
+	if volumes[0].ConfigMap == nil || volumes[0].ConfigMap.Name != "demo-config" {
+		t.Errorf("unexpected configmap volume %+v", volumes[0])
+	}
+	if volumes[1].Secret == nil || volumes[1].Secret.SecretName != "demo-tls" {
+		t.Errorf("unexpected secret volume %+v", volumes[1])
+	}
+
+	// 未引用时不渲染
+	d, err = templates.NewDeployment(newApp())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c := d.Spec.Template.Spec.Containers[0]; c.EnvFrom != nil || c.VolumeMounts != nil || d.Spec.Template.Spec.Volumes != nil {
+		t.Errorf("expected no config sources, got %+v", d.Spec.Template.Spec)
+	}
+}
+
+func TestRenderQuotesUserStrings(t *testing.T) {
+	templates, err := ParseTemplates(template.FS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// 未经 webhook 校验的值不能改变渲染出的 YAML 结构
+	injected := "/etc/demo\n          securityContext:\n            privileged: true"
+	app := newApp()
+	app.Spec.ConfigMaps = []v1beta1.AppConfigSource{{Name: "demo-config", MountPath: injected}}
+	app.Spec.Ingress.Annotations = map[string]string{"note": "line one\nline: two"}
+	app.Spec.Ingress.Host = "demo.example.com\n    - host: evil.example.com"
+
+	d, err := templates.NewDeployment(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c := d.Spec.Template.Spec.Containers[0]
+	if len(c.VolumeMounts) != 1 || c.VolumeMounts[0].MountPath != injected {
+		t.Errorf("expected the mountPath to be rendered verbatim, got %+v", c.VolumeMounts)
+	}
+	if c.SecurityContext != nil {
+		t.Errorf("expected no securityContext, got %+v", c.SecurityContext)
+	}
+
+	i, err := templates.NewIngress(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(i.Spec.Rules) != 1 || i.Spec.Rules[0].Host != app.Spec.Ingress.Host {
+		t.Errorf("expected a single rule with the host rendered verbatim, got %+v", i.Spec.Rules)
+	}
+	if i.Annotations["note"] != "line one\nline: two" {
+		t.Errorf("expected the annotation to be rendered verbatim, got %v", i.Annotations)
+	}
+}
+
+func TestTemplatesRenderContainers(t *testing.T) {
+	templates, err := ParseTemplates(template.FS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	app := newApp()
+	app.Spec.Image = ""
+	app.Spec.TargetPortName = "http"
+	app.Spec.Containers = []v1beta1.AppContainer{
+		{
+			Name:  "web",
+			Image: "nginx:1.23",
+			Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+			Env: []corev1.EnvVar{
+				{Name: "MODE", Value: "production"},
+				{Name: "POD_IP", ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "status.podIP"}}},
+			},
+			Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")}},
+		},
+		{Name: "proxy", Image: "envoyproxy/envoy:v1.22.0", Ports: []corev1.ContainerPort{{Name: "admin", ContainerPort: 9901}}},
+	}
+	app.Spec.InitContainers = []v1beta1.AppContainer{{Name: "migrate", Image: "migrate/migrate:v4"}}
+	app.Spec.ConfigMaps = []v1beta1.AppConfigSource{{Name: "demo-env", EnvFrom: true}}
+
+	d, err := templates.NewDeployment(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	spec := d.Spec.Template.Spec
+	if len(spec.InitContainers) != 1 || spec.InitContainers[0].Name != "migrate" || spec.InitContainers[0].Image != "migrate/migrate:v4" {
+		t.Errorf("unexpected init containers %+v", spec.InitContainers)
+	}
+	if len(spec.Containers) != 2 {
+		t.Fatalf("expected 2 containers, got %+v", spec.Containers)
+	}
+	web, proxy := spec.Containers[0], spec.Containers[1]
+	if web.Name != "web" || web.Ports[0].Name != "http" || web.Ports[0].ContainerPort != 8080 {
+		t.Errorf("unexpected web container %+v", web)
+	}
+	if len(web.Env) != 2 || web.Env[1].ValueFrom.FieldRef.FieldPath != "status.podIP" {
+		t.Errorf("unexpected env %+v", web.Env)
+	}
+	if memory := web.Resources.Limits[corev1.ResourceMemory]; memory.String() != "128Mi" {
+		t.Errorf("unexpected resources %+v", web.Resources)
+	}
+	// 配置只注入第一个容器
+	if len(web.EnvFrom) != 1 || proxy.EnvFrom != nil {
+		t.Errorf("expected envFrom on the first container only, got %+v and %+v", web.EnvFrom, proxy.EnvFrom)
+	}
+	if proxy.Image != "envoyproxy/envoy:v1.22.0" || proxy.Ports[0].ContainerPort != 9901 {
+		t.Errorf("unexpected proxy container %+v", proxy)
+	}
+
+	s, err := templates.NewService(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if target := s.Spec.Ports[0].TargetPort; target.Type != intstr.String || target.StrVal != "http" {
+		t.Errorf("expected targetPort http, got %+v", target)
+	}
+}
+
+func TestTemplatesRenderServiceAccount(t *testing.T) {
+	templates, err := ParseTemplates(template.FS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	app := newApp()
+	app.Spec.ServiceAccount = &v1beta1.AppServiceAccount{}
+	d, err := templates.NewDeployment(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name := d.Spec.Template.Spec.ServiceAccountName; name != "demo" {
+		t.Errorf("expected serviceAccountName demo, got %q", name)
+	}
+
+	// 未设置时使用命名空间默认的 ServiceAccount
+	d, err = templates.NewDeployment(newApp())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if name := d.Spec.Template.Spec.ServiceAccountName; name != "" {
+		t.Errorf("expected no serviceAccountName, got %q", name)
+	}
+}
+
+func TestTemplatesRenderNetworkPolicy(t *testing.T) {
+	templates, err := ParseTemplates(template.FS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	app := newApp()
+	app.Spec.NetworkPolicy = &v1beta1.AppNetworkPolicy{
+		IngressControllerNamespace: "ingress-nginx",
+		FromApps:                   []string{"frontend"},
+		FromCIDRs:                  []string{"10.0.0.0/8"},
+	}
+
+	np, err := templates.NewNetworkPolicy(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if np.Name != "demo" || np.Spec.PodSelector.MatchLabels["app"] != "demo" {
+		t.Errorf("unexpected network policy %+v", np)
+	}
+	if len(np.Spec.Ingress) != 1 || len(np.Spec.Ingress[0].From) != 3 {
+		t.Fatalf("unexpected ingress rules %+v", np.Spec.Ingress)
+	}
+	from := np.Spec.Ingress[0].From
+	if from[0].NamespaceSelector.MatchLabels["kubernetes.io/metadata.name"] != "ingress-nginx" {
+		t.Errorf("unexpected namespace peer %+v", from[0])
+	}
+	if from[1].PodSelector.MatchLabels["app"] != "frontend" {
+		t.Errorf("unexpected pod peer %+v", from[1])
+	}
+	if from[2].IPBlock == nil || from[2].IPBlock.CIDR != "10.0.0.0/8" {
+		t.Errorf("unexpected ip block peer %+v", from[2])
+	}
+
+	// 没有放行规则时拒绝所有入站流量
+	app.Spec.NetworkPolicy = &v1beta1.AppNetworkPolicy{}
+	np, err = templates.NewNetworkPolicy(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(np.Spec.Ingress) != 0 || len(np.Spec.PolicyTypes) != 1 {
+		t.Errorf("expected a deny all policy, got %+v", np.Spec)
+	}
+}
+
+func TestParseTemplatesErrors(t *testing.T) {
+	valid := func(name string) *fstest.MapFile {
+		b, err := template.FS.ReadFile(name)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return &fstest.MapFile{Data: b}
+	}
+
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{
+			name: "missing template",
+			fsys: fstest.MapFS{"deployment.yaml": valid("deployment.yaml"), "service.yaml": valid("service.yaml")},
+		},
+		{
+			name: "unparsable template",
+			fsys: fstest.MapFS{
+				"deployment.yaml":    &fstest.MapFile{Data: []byte("name: {{.ObjectMeta.Name")},
+				"service.yaml":       valid("service.yaml"),
+				"ingress.yaml":       valid("ingress.yaml"),
+				"networkpolicy.yaml": valid("networkpolicy.yaml"),
+			},
+		},
+		{
+			name: "unknown field",
+			fsys: fstest.MapFS{
+				"deployment.yaml":    valid("deployment.yaml"),
+				"service.yaml":       &fstest.MapFile{Data: []byte("metadata:\n  name: {{.Spec.NoSuchField}}")},
+				"ingress.yaml":       valid("ingress.yaml"),
+				"networkpolicy.yaml": valid("networkpolicy.yaml"),
+			},
+		},
+		{
+			name: "invalid yaml",
+			fsys: fstest.MapFS{
+				"deployment.yaml":    valid("deployment.yaml"),
+				"service.yaml":       valid("service.yaml"),
+				"ingress.yaml":       &fstest.MapFile{Data: []byte("spec:\n  rules: [\n")},
+				"networkpolicy.yaml": valid("networkpolicy.yaml"),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseTemplates(tt.fsys)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !IsTemplateError(err) {
+				t.Errorf("expected a TemplateError, got %T: %v", err, err)
+			}
+		})
+	}
+}
+
+func TestWithOverrides(t *testing.T) {
+	templates, err := ParseTemplates(template.FS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	overridden, err := templates.WithOverrides(map[string]string{
+		"service.yaml": `apiVersion: v1
+kind: Service
+metadata:
+  name: {{.ObjectMeta.Name}}
+  namespace: {{.ObjectMeta.Namespace}}
+  labels:
+    team: platform
+spec:
+  selector:
+    app: {{.ObjectMeta.Name}}
+  ports:
+    - port: 80
+`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s, err := overridden.NewService(newApp())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Labels["team"] != "platform" || s.Spec.Ports[0].Port != 80 {
+		t.Errorf("expected overridden service, got %+v", s)
+	}
+
+	// templates missing from the ConfigMap fall back to the built-ins
+	d, err := overridden.NewDeployment(newApp())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.Name != "demo" {
+		t.Errorf("unexpected deployment %+v", d)
+	}
+
+	// the built-ins are left untouched
+	s, err = templates.NewService(newApp())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := s.Labels["team"]; ok {
+		t.Errorf("expected built-in service, got %+v", s)
+	}
+
+	if _, err := templates.WithOverrides(map[string]string{"ingress.yaml": "{{.Spec"}); !IsTemplateError(err) {
+		t.Errorf("expected a TemplateError, got %v", err)
+	}
+}
+
+func TestWithOverridesKeepsNameAndNamespace(t *testing.T) {
+	templates, err := ParseTemplates(template.FS)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	overridden, err := templates.WithOverrides(map[string]string{
+		"service.yaml": `apiVersion: v1
+kind: Service
+metadata:
+  name: kubernetes
+  namespace: default
+spec:
+  ports:
+    - port: 443
+`,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	app := newApp()
+	app.Namespace = "team-a"
+	s, err := overridden.NewService(app)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Name != "demo" || s.Namespace != "team-a" {
+		t.Errorf("expected the service to be named after the app, got %s/%s", s.Namespace, s.Name)
+	}
+}
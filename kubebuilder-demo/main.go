@@ -19,20 +19,28 @@ package main
 import (
 	"flag"
 	"os"
+	"path/filepath"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	configv1alpha1 "kubebuilder-demo/api/config/v1alpha1"
 	ingressv1beta1 "kubebuilder-demo/api/v1beta1"
 	"kubebuilder-demo/controllers"
+	"kubebuilder-demo/controllers/certs"
+	"kubebuilder-demo/controllers/template"
+	"kubebuilder-demo/controllers/utils"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -43,20 +51,63 @@ var (
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
 
 	utilruntime.Must(ingressv1beta1.AddToScheme(scheme))
+	utilruntime.Must(configv1alpha1.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
+	var configFile string
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var maxReplicas int
+	var ingressClassName string
+	var ingressDomain string
+	var maxConcurrentReconciles int
+	var namespaces string
+	var certDir string
+	var certRotation bool
+	var certHosts string
+	var namePrefix string
+	var protectServingApps bool
+	var cacheManagedOnly bool
+	flag.StringVar(&configFile, "config", "",
+		"The controller will load its initial configuration from this file. "+
+			"Omit this flag to use the default configuration values. "+
+			"Command-line flags override configuration from this file.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&maxReplicas, "max-replicas", int(ingressv1beta1.MaxReplicas),
+		"The maximum spec.replicas accepted by the App validating webhook.")
+	flag.StringVar(&ingressClassName, "ingress-class", ingressv1beta1.DefaultIngressClassName,
+		"The IngressClass of Apps and IngressGroups that do not set one.")
+	flag.StringVar(&ingressDomain, "ingress-domain", ingressv1beta1.DefaultIngressDomain,
+		"The domain of the default App hosts.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1,
+		"The number of Apps reconciled in parallel.")
+	flag.StringVar(&namespaces, "namespaces", "",
+		"Comma separated namespaces whose Apps are reconciled, all namespaces when empty.")
+	flag.BoolVar(&cacheManagedOnly, "cache-managed-only", false,
+		"Cache only the Deployments, Services, Ingresses and other owned objects labelled "+
+			controllers.ManagedByLabel+"="+controllers.ManagedBy+".")
+	flag.BoolVar(&protectServingApps, "protect-serving-apps", false,
+		"Reject deleting Apps whose Ingress routes to ready replicas unless they are annotated "+
+			ingressv1beta1.ForceDeleteAnnotation+"=true.")
+	flag.StringVar(&certDir, "cert-dir", filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs"),
+		"The directory the webhook server loads tls.crt and tls.key from.")
+	flag.BoolVar(&certRotation, "cert-rotation", true,
+		"Generate the webhook certificate and inject its CA instead of relying on cert-manager.")
+	flag.StringVar(&certHosts, "cert-hosts", "",
+		"Comma separated DNS names and IP addresses added to the generated webhook certificate.")
+	flag.StringVar(&namePrefix, "name-prefix", "kubebuilder-demo-",
+		"The kustomize namePrefix of the deployed manifests, used to find the webhook Service and configurations. "+
+			"The RBAC rules of the certificate rotator only grant access to the names with the default prefix.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -65,22 +116,77 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	options := ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "1de8eaa9.mj.learn",
-	}
-
-	if os.Getenv("ENVIRONMENT") == "DEV" {
-		path, err := os.Getwd()
+	var err error
+	projectConfig := configv1alpha1.ProjectConfig{}
+	options := ctrl.Options{Scheme: scheme}
+	if configFile != "" {
+		options, err = options.AndFrom(ctrl.ConfigFile().AtPath(configFile).OfKind(&projectConfig))
 		if err != nil {
-			setupLog.Error(err, "unable to get work dir")
+			setupLog.Error(err, "unable to load the config file")
 			os.Exit(1)
 		}
-		options.CertDir = path + "/certs"
+	}
+
+	// 命令行显式指定的参数覆盖配置文件,两者都未指定时使用参数默认值
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if set["metrics-bind-address"] || options.MetricsBindAddress == "" {
+		options.MetricsBindAddress = metricsAddr
+	}
+	if set["health-probe-bind-address"] || options.HealthProbeBindAddress == "" {
+		options.HealthProbeBindAddress = probeAddr
+	}
+	if set["leader-elect"] {
+		options.LeaderElection = enableLeaderElection
+	}
+	if options.LeaderElectionID == "" {
+		options.LeaderElectionID = "1de8eaa9.mj.learn"
+	}
+	if options.Port == 0 {
+		options.Port = 9443
+	}
+	if set["ingress-class"] || projectConfig.IngressClassName == "" {
+		projectConfig.IngressClassName = ingressClassName
+	}
+	if set["ingress-domain"] || projectConfig.IngressDomain == "" {
+		projectConfig.IngressDomain = ingressDomain
+	}
+	if set["max-concurrent-reconciles"] || projectConfig.MaxConcurrentReconciles == 0 {
+		projectConfig.MaxConcurrentReconciles = maxConcurrentReconciles
+	}
+	if set["max-replicas"] || projectConfig.MaxReplicas == 0 {
+		projectConfig.MaxReplicas = int32(maxReplicas)
+	}
+	if set["protect-serving-apps"] {
+		projectConfig.ProtectServingApps = protectServingApps
+	}
+	if set["namespaces"] {
+		projectConfig.Namespaces = splitList(namespaces)
+	}
+	if set["cache-managed-only"] {
+		projectConfig.CacheManagedOnly = cacheManagedOnly
+	}
+	if err := projectConfig.Validate(); err != nil {
+		setupLog.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+
+	ingressv1beta1.MaxReplicas = projectConfig.MaxReplicas
+	ingressv1beta1.DefaultIngressClassName = projectConfig.IngressClassName
+	ingressv1beta1.DefaultIngressDomain = projectConfig.IngressDomain
+	ingressv1beta1.ProtectServingApps = projectConfig.ProtectServingApps
+	if len(projectConfig.RoleRules.AllowedVerbs) > 0 {
+		ingressv1beta1.AllowedRoleVerbs = projectConfig.RoleRules.AllowedVerbs
+	}
+	if len(projectConfig.RoleRules.AllowedResources) > 0 {
+		ingressv1beta1.AllowedRoleResources = projectConfig.RoleRules.AllowedResources
+	}
+	options.NewCache = controllers.NewCache(projectConfig.Namespaces, projectConfig.CacheManagedOnly)
+
+	if set["cert-dir"] || options.CertDir == "" {
+		options.CertDir = certDir
 	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
@@ -89,20 +195,81 @@ func main() {
 		os.Exit(1)
 	}
 
+	templates, err := utils.ParseTemplates(template.FS)
+	if err != nil {
+		setupLog.Error(err, "unable to parse templates")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.AppReconciler{
-		Client:   mgr.GetClient(),
-		Scheme:   mgr.GetScheme(),
-		Recorder: mgr.GetEventRecorderFor("app"),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Recorder:                mgr.GetEventRecorderFor("app"),
+		Templates:               templates,
+		APIReader:               mgr.GetAPIReader(),
+		MaxConcurrentReconciles: projectConfig.MaxConcurrentReconciles,
+		RateLimiter: controllers.NewRateLimiter(
+			projectConfig.RateLimiter.BaseDelay.Duration,
+			projectConfig.RateLimiter.MaxDelay.Duration,
+			projectConfig.RateLimiter.QPS,
+			projectConfig.RateLimiter.Burst,
+		),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "App")
 		os.Exit(1)
 	}
-	if err = (&ingressv1beta1.App{}).SetupWebhookWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create webhook", "webhook", "App")
+	if err = (&controllers.IngressGroupReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("ingressgroup"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "IngressGroup")
 		os.Exit(1)
 	}
 	// +kubebuilder:scaffold:builder
 
+	setupWebhooks := func() {
+		if err := (&ingressv1beta1.App{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "App")
+			os.Exit(1)
+		}
+	}
+	if certRotation {
+		namespace := os.Getenv("POD_NAMESPACE")
+		if namespace == "" {
+			namespace = namePrefix + "system"
+		}
+		service := namePrefix + "webhook-service"
+		rotator := &certs.Rotator{
+			Client:    mgr.GetClient(),
+			Reader:    mgr.GetAPIReader(),
+			SecretKey: types.NamespacedName{Namespace: namespace, Name: "webhook-server-cert"},
+			CertDir:   options.CertDir,
+			Hosts: append([]string{
+				service + "." + namespace + ".svc",
+				service + "." + namespace + ".svc.cluster.local",
+			}, splitList(certHosts)...),
+			MutatingWebhooks:   []string{namePrefix + "mutating-webhook-configuration"},
+			ValidatingWebhooks: []string{namePrefix + "validating-webhook-configuration"},
+			CRDs:               []string{"apps.ingress.mj.learn", "ingressgroups.ingress.mj.learn"},
+		}
+		if err := mgr.Add(rotator); err != nil {
+			setupLog.Error(err, "unable to set up cert rotation")
+			os.Exit(1)
+		}
+		if err := mgr.AddReadyzCheck("certs", rotator.ReadyzCheck); err != nil {
+			setupLog.Error(err, "unable to set up ready check")
+			os.Exit(1)
+		}
+		// webhook server 启动时证书必须已经存在,证书生成后再注册 webhook
+		go func() {
+			<-rotator.Ready()
+			setupWebhooks()
+		}()
+	} else {
+		setupWebhooks()
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -118,3 +285,14 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}